@@ -27,8 +27,8 @@ import (
 	"os/signal"
 	"time"
 
-	"github.com/pmferg/rtldavis/protocol"
 	"github.com/jpoirier/gortlsdr"
+	"github.com/pmferg/rtldavis/protocol"
 )
 
 var (
@@ -94,6 +94,9 @@ func main() {
 	go func() {
 		for hop := range nextHop {
 			verboseLogger.Printf("Hop: %s\n", hop)
+			if hop.Disabled {
+				continue
+			}
 			if err := dev.SetCenterFreq(hop.ChannelFreq + hop.FreqError); err != nil {
 				log.Fatal(err)
 			}
@@ -116,10 +119,12 @@ func main() {
 	// Set the dwellTimer for one full rotation of the pattern + 1. Some channels
 	// may have enough frequency error that they won't receive until we've
 	// seen at least one message and set the frequency correction.
-	dwellTimer := time.After(52 * p.DwellTime)
+	dwellTimer := time.After(p.ResyncDwell())
 	// We set missCount to 3 so that we immediately pick another random
 	// channel and wait on that channel instead of hopping like we missed one.
 	missCount := 3
+	// The hop we're currently dwelling on.
+	current := hop
 
 	for {
 		select {
@@ -132,19 +137,24 @@ func main() {
 			//        full cycle of the pattern.
 
 			// Reset the timer and incrmeent the missed packet counter.
-			dwellTimer = time.After(p.DwellTime)
-			missCount++
+			// Disabled channels aren't listened on so can't miss.
+			dwellTimer = time.After(p.CurrentDwell())
+			if !current.Disabled {
+				p.Missed()
+				missCount++
+			}
 
 			if missCount >= 3 {
 				// We've missed three packets in a row, hop to a random
 				// channel and wait for a full hopping cycle.
-				nextHop <- p.RandHop()
-				dwellTimer = time.After(52 * p.DwellTime)
+				current = p.RandHop()
+				dwellTimer = time.After(p.ResyncDwell())
 			} else {
 				// We've missed fewer than three packets in a row, hop to the
 				// next channel in the pattern.
-				nextHop <- p.NextHop()
+				current = p.NextHop()
 			}
+			nextHop <- current
 		default:
 			in.Read(block)
 
@@ -167,10 +177,12 @@ func main() {
 				// packet hopping logic will reset the timer to exactly the
 				// dwell time and we then expect packets to arrive half-way
 				// through the timer.
-				dwellTimer = time.After(p.DwellTime + p.DwellTime>>1)
+				dwell := p.CurrentDwell()
+				dwellTimer = time.After(dwell + dwell>>1)
 
 				// Hop to the next channel.
-				nextHop <- p.NextHop()
+				current = p.NextHop()
+				nextHop <- current
 			}
 		}
 	}
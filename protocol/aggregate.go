@@ -0,0 +1,164 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package protocol
+
+import "time"
+
+// Reading is a decoded value and the time it was received. A zero Time means
+// the reading has never been received. Stale is set when the reading is older
+// than the aggregator's TTL.
+type Reading struct {
+	Value float64
+	Time  time.Time
+	Stale bool
+}
+
+// Observation is the latest known value of each reading from a transmitter.
+// Each packet carries wind and one other sensor, so an observation fills in
+// over a full sensor rotation.
+type Observation struct {
+	ID byte
+
+	WindSpeed     Reading
+	WindDirection Reading
+
+	Temperature    Reading
+	Humidity       Reading
+	RainRate       Reading
+	UVIndex        Reading
+	SolarRadiation Reading
+
+	// Temperature from the extra probe, kept apart from the air
+	// temperature.
+	ExtraTemperature Reading
+
+	// Tip counter of the first rain collector as received. It wraps, so
+	// rainfall is best totalled with a RainAccumulator.
+	RainClicks Reading
+}
+
+func (o *Observation) readings() []*Reading {
+	return []*Reading{
+		&o.WindSpeed, &o.WindDirection,
+		&o.Temperature, &o.Humidity, &o.RainRate, &o.UVIndex, &o.SolarRadiation,
+		&o.ExtraTemperature, &o.RainClicks,
+	}
+}
+
+// Aggregator merges messages into observations per transmitter id.
+type Aggregator struct {
+	// Readings not refreshed within TTL are marked stale by Latest. Zero
+	// means readings never go stale.
+	TTL time.Duration
+
+	observations map[byte]Observation
+	last         map[byte]map[Sensor]Message
+
+	now func() time.Time
+}
+
+func NewAggregator() *Aggregator {
+	return &Aggregator{
+		observations: make(map[byte]Observation),
+		last:         make(map[byte]map[Sensor]Message),
+		now:          time.Now,
+	}
+}
+
+// SetClock replaces the clock used for marking readings stale, for testing.
+// A nil clock restores time.Now.
+func (a *Aggregator) SetClock(now func() time.Time) {
+	if now == nil {
+		now = time.Now
+	}
+	a.now = now
+}
+
+// Add merges the message's readings into its transmitter's observation.
+func (a *Aggregator) Add(msg Message) {
+	obs := a.observations[msg.ID]
+	obs.ID = msg.ID
+
+	if speed, ok := msg.WindSpeedMPH(); ok {
+		obs.WindSpeed = Reading{Value: speed, Time: msg.Time}
+	}
+	if dir, ok := msg.WindDirectionDegrees(); ok {
+		obs.WindDirection = Reading{Value: dir, Time: msg.Time}
+	}
+
+	var field *Reading
+	switch msg.Sensor {
+	case Temperature:
+		field = &obs.Temperature
+	case ExtraTemperature:
+		field = &obs.ExtraTemperature
+	case Humidity:
+		field = &obs.Humidity
+	case RainRate:
+		field = &obs.RainRate
+	case UVIndex:
+		field = &obs.UVIndex
+	case SolarRadiation:
+		field = &obs.SolarRadiation
+	case Rain:
+		if msg.Collector == 0 {
+			field = &obs.RainClicks
+		}
+	}
+
+	if field != nil {
+		if value, ok := msg.Value(); ok {
+			*field = Reading{Value: value, Time: msg.Time}
+		}
+	}
+
+	a.observations[msg.ID] = obs
+
+	last, exists := a.last[msg.ID]
+	if !exists {
+		last = make(map[Sensor]Message)
+		a.last[msg.ID] = last
+	}
+	last[msg.Sensor] = msg
+}
+
+// LastReadings returns the most recent message of each sensor type received
+// from the transmitter.
+func (a *Aggregator) LastReadings(id byte) map[Sensor]Message {
+	readings := make(map[Sensor]Message, len(a.last[id]))
+	for sensor, msg := range a.last[id] {
+		readings[sensor] = msg
+	}
+	return readings
+}
+
+// Latest returns the latest observation from the transmitter, marking
+// readings older than TTL as stale.
+func (a *Aggregator) Latest(id byte) Observation {
+	obs := a.observations[id]
+	obs.ID = id
+
+	if a.TTL > 0 {
+		now := a.now()
+		for _, r := range obs.readings() {
+			r.Stale = !r.Time.IsZero() && now.Sub(r.Time) > a.TTL
+		}
+	}
+
+	return obs
+}
@@ -0,0 +1,564 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package protocol
+
+import "math"
+
+// Message payload layout, after the sync word has been stripped and the bit
+// order corrected:
+//
+//	Data[0]    bits 7-4: sensor type, bits 3-0: transmitter id
+//	Data[1]    wind speed
+//	Data[2]    wind direction
+//	Data[3:5]  sensor reading, meaning depends on sensor type
+//	Data[5]    sensor specific flags
+//	Data[6:8]  CRC
+//
+// Accessors below return the decoded value and whether the message carries
+// that reading at all.
+
+// DecodeOptions control how ambiguous readings are interpreted.
+type DecodeOptions struct {
+	// Station model of the transmitter, some readings are scaled differently.
+	Model StationModel
+
+	// The wind vane has a dead band near north in which it reports 0, which
+	// is indistinguishable from a packet without wind direction. When set,
+	// a direction of 0 is treated as missing rather than north.
+	ZeroWindDirInvalid bool
+
+	// Size of the rain collector's bucket, each tip is one click.
+	RainBucket RainBucket
+}
+
+// StationModel selects between the decode tables of different ISS models.
+//
+// Differences currently handled:
+//
+//	Wind direction  Pro2: 9 to 351 degrees over 0-255, the vane never reports
+//	                north exactly. Vue: 0 to 358.6 degrees in steps of 360/256.
+//
+// Humidity has no documented difference between the models and is decoded the
+// same on both.
+type StationModel int
+
+const (
+	Pro2 StationModel = iota
+	Vue
+)
+
+func (s StationModel) String() string {
+	switch s {
+	case Vue:
+		return "Vue"
+	default:
+		return "Pro2"
+	}
+}
+
+// RainBucket is the depth of rain per click of the collector.
+type RainBucket int
+
+const (
+	Bucket001in RainBucket = iota // 0.01 in, standard in the US.
+	Bucket02mm                    // 0.2 mm, standard elsewhere.
+	Bucket01mm                    // 0.1 mm, fitted to some European collectors.
+)
+
+// MM returns the depth of rain per click in millimetres.
+func (b RainBucket) MM() float64 {
+	switch b {
+	case Bucket02mm:
+		return 0.2
+	case Bucket01mm:
+		return 0.1
+	default:
+		return 0.254
+	}
+}
+
+// DepthMM returns the depth of rain in millimetres for a number of clicks.
+func (b RainBucket) DepthMM(clicks int) float64 {
+	return float64(clicks) * b.MM()
+}
+
+// DepthIn returns the depth of rain in inches for a number of clicks.
+func (b RainBucket) DepthIn(clicks int) float64 {
+	return b.DepthMM(clicks) / 25.4
+}
+
+func (b RainBucket) String() string {
+	switch b {
+	case Bucket02mm:
+		return "0.2mm"
+	case Bucket01mm:
+		return "0.1mm"
+	default:
+		return "0.01in"
+	}
+}
+
+// Transmitters without a wind sensor send 0xFF in both wind bytes, the
+// floating inputs reading full scale.
+const noWindSensor = 0xFF
+
+// HasWindSensor reports whether the transmitter has a wind sensor connected.
+func (m Message) HasWindSensor() bool {
+	return !(m.WindSpeed == noWindSensor && m.WindDirection == noWindSensor)
+}
+
+// WindDirectionValid reports whether the message carries a usable wind
+// direction.
+func (m Message) WindDirectionValid() bool {
+	return m.HasWindSensor() && !(m.Options.ZeroWindDirInvalid && m.WindDirection == 0)
+}
+
+// WindSpeedMPH returns the wind speed in miles per hour. The speed is the
+// single byte in Data[1], no documented firmware extends it beyond 255 mph,
+// well above the 253 mph record gust.
+func (m Message) WindSpeedMPH() (float64, bool) {
+	if !m.HasWindSensor() {
+		return 0, false
+	}
+	return float64(m.WindSpeed), true
+}
+
+// WindGustMPH returns the peak wind speed in miles per hour since the previous
+// WindGustSpeed packet, carried in Data[3].
+func (m Message) WindGustMPH() (float64, bool) {
+	if m.Sensor != WindGustSpeed {
+		return 0, false
+	}
+	return float64(m.Data[3]), true
+}
+
+// IsCalm reports whether there is no wind, in which case the wind direction
+// is undefined rather than north.
+func (m Message) IsCalm() bool {
+	speed, ok := m.WindSpeedMPH()
+	return ok && speed == 0
+}
+
+// WindDirectionDegrees returns the wind direction in degrees clockwise from
+// north, scaled according to the station model.
+func (m Message) WindDirectionDegrees() (float64, bool) {
+	if !m.WindDirectionValid() {
+		return 0, false
+	}
+
+	if m.Options.Model == Vue {
+		return float64(m.WindDirection) * 360 / 256, true
+	}
+	return 9 + float64(m.WindDirection)*342/255, true
+}
+
+// SolarCharging would report whether the solar panel is charging the
+// supercap. No documented packet carries a charging flag, the low bits of
+// SuperCapVoltage packets below the voltage reading are unassigned, so
+// SolarCharging always reports it as unavailable.
+func (m Message) SolarCharging() (charging, ok bool) {
+	return false, false
+}
+
+// ChargeCurrent would return the current the solar panel is sourcing. Like
+// the charging state, see SolarCharging, it is never transmitted, so
+// ChargeCurrent always reports the current as unavailable.
+func (m Message) ChargeCurrent() (float64, bool) {
+	return 0, false
+}
+
+// reading returns the raw sixteen-bit sensor reading.
+func (m Message) reading() uint16 {
+	return uint16(m.Data[3])<<8 | uint16(m.Data[4])
+}
+
+// Value returns the decoded reading for the message's sensor type: gusts in
+// mph, rain as the tip counter and SoilLeaf readings in their probe's units.
+// Sensors without a decode, such as SuperCapVoltage and Light, return false.
+func (m Message) Value() (float64, bool) {
+	switch m.Sensor {
+	case Temperature, ExtraTemperature:
+		return m.Temperature()
+	case Humidity:
+		return m.Humidity()
+	case UVIndex:
+		return m.UVIndex()
+	case SolarRadiation:
+		return m.SolarRadiation()
+	case RainRate:
+		return m.RainRateIn()
+	case WindGustSpeed:
+		return m.WindGustMPH()
+	case Rain:
+		clicks, ok := m.RainClicks()
+		return float64(clicks), ok
+	case SoilLeaf:
+		return m.soilLeafValue()
+	default:
+		return 0, false
+	}
+}
+
+// Physical limits of each sensor's decoded value, in Value's units.
+var plausibleRanges = map[Sensor]struct{ min, max float64 }{
+	Temperature:      {-60, 150},
+	ExtraTemperature: {-60, 150},
+	Humidity:         {0, 100},
+	UVIndex:          {0, 16},
+	SolarRadiation:   {0, 1800},
+	RainRate:         {0, 40},
+}
+
+// Highest plausible wind speed in mph.
+const maxPlausibleWind = 200
+
+// Plausible reports whether the message's wind speed and decoded value are
+// within physical limits. Values which don't decode, and sensors without known
+// limits, are considered plausible.
+func (m Message) Plausible() bool {
+	if speed, ok := m.WindSpeedMPH(); ok && speed > maxPlausibleWind {
+		return false
+	}
+
+	limits, exists := plausibleRanges[m.Sensor]
+	if !exists {
+		return true
+	}
+
+	value, ok := m.Value()
+	return !ok || limits.min <= value && value <= limits.max
+}
+
+// Temperature returns the temperature in degrees Fahrenheit from either the
+// air temperature sensor or the extra probe, see TemperatureProbe. The reading
+// is a signed twelve-bit value in tenths of a degree, the low nibble of
+// Data[4] is unused.
+func (m Message) Temperature() (float64, bool) {
+	if _, ok := m.TemperatureProbe(); !ok {
+		return 0, false
+	}
+	return float64(int16(m.reading())>>4) / 10, true
+}
+
+// TemperatureProbe returns which probe a temperature reading is from: 0
+// for the air temperature sensor, 1 for the extra probe sent as
+// ExtraTemperature packets.
+func (m Message) TemperatureProbe() (int, bool) {
+	switch m.Sensor {
+	case Temperature:
+		return 0, true
+	case ExtraTemperature:
+		return 1, true
+	}
+	return 0, false
+}
+
+// Humidity returns the relative humidity in percent. The reading is a
+// twelve-bit value in tenths of a percent, the low byte in Data[3] and the high
+// nibble in the top of Data[4], on either station model.
+func (m Message) Humidity() (float64, bool) {
+	if m.Sensor != Humidity {
+		return 0, false
+	}
+	return float64(uint16(m.Data[4]>>4)<<8|uint16(m.Data[3])) / 10, true
+}
+
+// UV and solar sensors report a ten-bit reading in Data[3] and the top two
+// bits of Data[4]. No documented sensor has a second, scaled range, so the
+// low bits of Data[4] are ignored. A reading of all ones means the sensor
+// isn't connected, while zero is genuine, e.g. solar radiation at night.
+
+// Ten-bit reading sent by a sensor which isn't connected.
+const disconnectedReading = 0x3FF
+
+func (m Message) tenBitReading() (float64, bool) {
+	raw := m.reading() >> 6
+	if raw == disconnectedReading {
+		return 0, false
+	}
+	return float64(raw), true
+}
+
+// UVIndex returns the UV index, the reading is in fiftieths.
+func (m Message) UVIndex() (float64, bool) {
+	if m.Sensor != UVIndex {
+		return 0, false
+	}
+
+	val, ok := m.tenBitReading()
+	return val / 50, ok
+}
+
+// SolarRadiation returns the solar radiation in W/m^2, each count of the
+// reading is 1.757936 W/m^2.
+func (m Message) SolarRadiation() (float64, bool) {
+	if m.Sensor != SolarRadiation {
+		return 0, false
+	}
+
+	val, ok := m.tenBitReading()
+	return val * 1.757936, ok
+}
+
+// RainRateClicks returns the rain rate in bucket tips per hour, independent of
+// the bucket size. RainRate packets carry the time between the last two clicks
+// of the collector, Data[3] holds the low byte and bits 5-4 of Data[4] the
+// high bits in units of 250. With bit 6 of Data[4] set the time is in seconds,
+// otherwise it is in sixteenths for heavy rain. Data[3] of 0xFF means no rain.
+//
+// In light rain the timer saturates at 1004 seconds (0xFE in Data[3] with both
+// high bits set), the time between clicks is then unknown and the rate is
+// reported as zero rather than 3.6 clicks per hour.
+//
+// No documented firmware has a finer heavy rain timing than sixteenths, bit 7
+// of Data[4] is ignored.
+func (m Message) RainRateClicks() (float64, bool) {
+	if m.Sensor != RainRate {
+		return 0, false
+	}
+	if m.Data[3] == 0xFF || m.rainRateOverflow() {
+		return 0, true
+	}
+
+	interval := float64(m.Data[4]&0x30>>4)*250 + float64(m.Data[3])
+	if m.Data[4]&0x40 == 0 {
+		interval /= 16
+	}
+	if interval == 0 {
+		return 0, false
+	}
+
+	return 3600 / interval, true
+}
+
+// rainRateOverflow reports whether the light rain timer has saturated.
+func (m Message) rainRateOverflow() bool {
+	return m.Data[3] == 0xFE && m.Data[4]&0x70 == 0x70
+}
+
+// rainCounterMask selects the bucket tip counter in Data[3] of Rain messages,
+// the top bit being the collector index.
+const rainCounterMask = 0x7F
+
+// Stations configured without a rain collector send 0xFF in both Data[3] and
+// Data[4] of Rain messages. Data[4] is otherwise clear, so a counter of 127 on
+// the second collector is still told apart.
+func (m Message) noRainCollector() bool {
+	return m.Data[3] == 0xFF && m.Data[4] == 0xFF
+}
+
+// RainClicks returns the running count of rain bucket tips. The counter is 7
+// bits wide and wraps at 128. Not available without a rain collector.
+func (m Message) RainClicks() (int, bool) {
+	if m.Sensor != Rain || m.noRainCollector() {
+		return 0, false
+	}
+	return int(m.Data[3] & rainCounterMask), true
+}
+
+// RainRateMM returns the rain rate in mm/hr.
+func (m Message) RainRateMM() (float64, bool) {
+	rate, ok := m.RainRateClicks()
+	return rate * m.Options.RainBucket.MM(), ok
+}
+
+// RainRateIn returns the rain rate in in/hr.
+func (m Message) RainRateIn() (float64, bool) {
+	rate, ok := m.RainRateMM()
+	return rate / 25.4, ok
+}
+
+// Station returns the transmitter number as configured on the console. The
+// ISS and any auxiliary temperature/humidity stations all send the same
+// sensor types and are told apart only by their id, numbered from 1 on the
+// console but from 0 over the air.
+func (m Message) Station() int {
+	return int(m.ID) + 1
+}
+
+// Equal reports whether two messages carry the same readings: sensor type,
+// transmitter id, wind and the decoded sensor value. Raw bytes are not
+// compared since unused bits may differ between otherwise identical readings,
+// except the raw reading of sensors without a decode.
+func (m Message) Equal(other Message) bool {
+	if m.ID != other.ID || m.Sensor != other.Sensor {
+		return false
+	}
+	if m.WindSpeed != other.WindSpeed || m.WindDirection != other.WindDirection {
+		return false
+	}
+
+	value, ok := m.Value()
+	otherValue, otherOk := other.Value()
+	if !ok && !otherOk {
+		return m.reading() == other.reading()
+	}
+
+	return ok == otherOk && value == otherValue
+}
+
+// ExtendedWindDirection would return a finer than eight-bit wind direction in
+// degrees. No documented ISS firmware sends one, the direction is only ever
+// the single byte in Data[2], so ExtendedWindDirection always reports it as
+// unavailable. See WindDirectionDegrees.
+func (m Message) ExtendedWindDirection() (float64, bool) {
+	return 0, false
+}
+
+// Forecast would return the console's barometric trend or forecast. These are
+// computed by the console from its own barometer and are never sent by the
+// ISS, so no sensor type carries them and Forecast always reports them as
+// unavailable. Packets are never decoded as forecasts.
+func (m Message) Forecast() (int, bool) {
+	return 0, false
+}
+
+// Soil & Leaf stations send SoilLeaf packets which carry no wind. Instead the
+// high nibble of Data[1] holds the kind of measurement and the low nibble the
+// port (1-4) of the probe it was taken from. The reading is ten bits wide, in
+// Data[3] and the top two bits of Data[4]. A reading of all ones means no
+// probe is connected to the port.
+const (
+	soilTemperature = 1
+	soilMoisture    = 2
+	leafWetness     = 3
+	leafTemperature = 4
+)
+
+func (m Message) soilLeaf(kind byte) (uint16, bool) {
+	if m.Sensor != SoilLeaf || m.Data[1]>>4 != kind {
+		return 0, false
+	}
+
+	raw := m.reading() >> 6
+	if raw == disconnectedReading {
+		return 0, false
+	}
+	return raw, true
+}
+
+// soilLeafValue decodes a SoilLeaf reading according to its kind.
+func (m Message) soilLeafValue() (float64, bool) {
+	switch m.Data[1] >> 4 {
+	case soilTemperature:
+		return m.SoilTemperatureF()
+	case soilMoisture:
+		return m.SoilMoistureCB()
+	case leafWetness:
+		wetness, ok := m.LeafWetness()
+		return float64(wetness), ok
+	case leafTemperature:
+		return m.LeafTemperatureF()
+	default:
+		return 0, false
+	}
+}
+
+// SoilLeafPort returns the port of the probe a SoilLeaf reading was taken
+// from.
+func (m Message) SoilLeafPort() (int, bool) {
+	if m.Sensor != SoilLeaf {
+		return 0, false
+	}
+	return int(m.Data[1] & 0xF), true
+}
+
+// SoilTemperatureF returns the soil temperature in degrees Fahrenheit. Unlike
+// air temperature the reading is unsigned, in quarter degrees above -40.
+func (m Message) SoilTemperatureF() (float64, bool) {
+	return m.probeTemperatureF(soilTemperature)
+}
+
+// SoilTemperatureC returns the soil temperature in degrees Celsius.
+func (m Message) SoilTemperatureC() (float64, bool) {
+	f, ok := m.SoilTemperatureF()
+	return (f - 32) * 5 / 9, ok
+}
+
+// LeafTemperatureF returns the leaf temperature in degrees Fahrenheit, sent by
+// stations with leaf temperature probes under their own kind but encoded like
+// soil temperature.
+func (m Message) LeafTemperatureF() (float64, bool) {
+	return m.probeTemperatureF(leafTemperature)
+}
+
+func (m Message) probeTemperatureF(kind byte) (float64, bool) {
+	raw, ok := m.soilLeaf(kind)
+	if !ok {
+		return 0, false
+	}
+	return float64(raw)/4 - 40, true
+}
+
+// Watermark soil moisture probes are read as a resistance in 1/32 kOhm units.
+// The resistance is converted with the Shock et al. calibration at the 24C
+// the console assumes, and limited to the probe's 0-200 cb range.
+const (
+	moistureOhmsPerCount = 1000.0 / 32
+	moistureTempC        = 24
+	maxMoistureCB        = 200
+)
+
+// SoilMoistureCB returns the soil water tension in centibars, from 0 (wet)
+// to 200 (dry).
+func (m Message) SoilMoistureCB() (float64, bool) {
+	raw, ok := m.soilLeaf(soilMoisture)
+	if !ok {
+		return 0, false
+	}
+
+	kOhms := float64(raw) * moistureOhmsPerCount / 1000
+	denom := 1 - 0.009733*kOhms - 0.01205*moistureTempC
+	if denom <= 0 {
+		return maxMoistureCB, true
+	}
+
+	cb := (4.093 + 3.213*kOhms) / denom
+	return math.Max(0, math.Min(cb, maxMoistureCB)), true
+}
+
+// LeafWetness returns leaf wetness on the Davis scale from 0 (dry) to 15
+// (wet), the top four bits of the reading.
+func (m Message) LeafWetness() (int, bool) {
+	raw, ok := m.soilLeaf(leafWetness)
+	if !ok {
+		return 0, false
+	}
+	return int(raw >> 6), true
+}
+
+// Pressure would return the barometric pressure in inHg. The barometer is part
+// of the console, not the ISS, and pressure is never transmitted over the
+// ISS link, so Pressure always reports it as unavailable.
+func (m Message) Pressure() (float64, bool) {
+	return 0, false
+}
+
+// TransmitMode would return a transmit power or mode hint. No known ISS
+// firmware encodes one in the payload, transmitters always send at a fixed
+// power and period, so TransmitMode always reports it as unavailable.
+func (m Message) TransmitMode() (int, bool) {
+	return 0, false
+}
+
+// FirmwareHint would return the transmitter's firmware version. No packet seen
+// from an ISS carries one, the closest thing to a diagnostics packet being
+// SuperCapVoltage, so FirmwareHint always reports it as unavailable.
+func (m Message) FirmwareHint() (int, bool) {
+	return 0, false
+}
@@ -0,0 +1,99 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package protocol
+
+import (
+	"fmt"
+	"time"
+)
+
+// EventKind is the kind of an Event.
+type EventKind int
+
+const (
+	// A packet passed the checksum.
+	EventReceived EventKind = iota
+	// A packet failed the checksum.
+	EventCRCFailure
+	// The parser resynced, see RandHop.
+	EventResync
+	// The parser hopped to the next channel.
+	EventHop
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventReceived:
+		return "Received"
+	case EventCRCFailure:
+		return "CRC Failure"
+	case EventResync:
+		return "Resync"
+	case EventHop:
+		return "Hop"
+	default:
+		return fmt.Sprintf("EventKind(%d)", int(k))
+	}
+}
+
+// Event is something which happened to the parser. ChannelIdx is the channel
+// the parser was on, or for hops and resyncs the channel moved to. Detail
+// holds the packet's data in hex, or the new hop.
+type Event struct {
+	Time       time.Time
+	Kind       EventKind
+	ChannelIdx int
+	Detail     string
+}
+
+// Events returns a channel of the parser's events, created with room for
+// EventBuffer events by the first call. Events are only sent once Events has
+// been called, and are dropped while the channel is full so a slow reader
+// never blocks parsing.
+func (p *Parser) Events() <-chan Event {
+	if p.events == nil {
+		p.events = make(chan Event, p.EventBuffer)
+	}
+	return p.events
+}
+
+// emitData sends an event detailing a packet's data. The detail is only
+// formatted if Events has been called.
+func (p *Parser) emitData(kind EventKind, data []byte) {
+	if p.events != nil {
+		p.emit(kind, fmt.Sprintf("%02X", data))
+	}
+}
+
+// emitHop sends an event detailing a hop. The detail is only formatted if
+// Events has been called.
+func (p *Parser) emitHop(kind EventKind, h Hop) {
+	if p.events != nil {
+		p.emit(kind, h.String())
+	}
+}
+
+// emit sends an event on the current channel, dropping it if the channel is
+// full. Events must have been called.
+func (p *Parser) emit(kind EventKind, detail string) {
+	event := Event{p.now(), kind, p.hopPattern[p.hopIdx], detail}
+	select {
+	case p.events <- event:
+	default:
+	}
+}
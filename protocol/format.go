@@ -0,0 +1,76 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package protocol
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var influxTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// InfluxLine formats the message's decoded value in InfluxDB line protocol:
+//
+//	davis,id=1,sensor=temperature value=72.3 1433116800000000000
+//
+// The timestamp is omitted if the message has no Time. Returns false if the
+// message has no decodable value.
+func (m Message) InfluxLine() (string, bool) {
+	value, ok := m.Value()
+	if !ok {
+		return "", false
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("davis,id=")
+	buf.WriteString(strconv.Itoa(int(m.ID)))
+	buf.WriteString(",sensor=")
+	buf.WriteString(influxTagEscaper.Replace(strings.ToLower(m.Sensor.String())))
+	buf.WriteString(" value=")
+	buf.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+
+	if !m.Time.IsZero() {
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatInt(m.Time.UnixNano(), 10))
+	}
+
+	return buf.String(), true
+}
+
+// CSVHeader returns the column names of the rows produced by CSVRow.
+func CSVHeader() []string {
+	return []string{"time", "id", "sensor", "value"}
+}
+
+// CSVRow formats the message as a row of CSVHeader's columns, suitable for
+// encoding/csv. The time is RFC 3339, time and value are left empty if the
+// message has no Time or no decodable value.
+func (m Message) CSVRow() []string {
+	row := []string{"", strconv.Itoa(int(m.ID)), m.Sensor.String(), ""}
+
+	if !m.Time.IsZero() {
+		row[0] = m.Time.Format(time.RFC3339Nano)
+	}
+	if value, ok := m.Value(); ok {
+		row[3] = strconv.FormatFloat(value, 'f', -1, 64)
+	}
+
+	return row
+}
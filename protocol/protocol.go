@@ -18,23 +18,166 @@
 package protocol
 
 import (
+	"bytes"
 	"fmt"
 	"math"
 	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/bemasher/rtldavis/crc"
 	"github.com/bemasher/rtldavis/dsp"
 )
 
+// SyncWord is the sync word preceding every packet.
+const SyncWord = "1100101110001001"
+
 func NewPacketConfig(symbolLength int) (cfg dsp.PacketConfig) {
+	cfg, _ = NewSyncPacketConfig(symbolLength, SyncWord)
+	return cfg
+}
+
+// NewSyncPacketConfig returns a packet config searching for the given sync
+// word, which must be a string of 16 binary digits.
+func NewSyncPacketConfig(symbolLength int, syncWord string) (cfg dsp.PacketConfig, err error) {
+	const syncSymbols = 16
+
+	if len(syncWord) != syncSymbols {
+		return cfg, fmt.Errorf("sync word %q must be %d symbols long", syncWord, syncSymbols)
+	}
+	if strings.Trim(syncWord, "01") != "" {
+		return cfg, fmt.Errorf("sync word %q must only contain 0 and 1", syncWord)
+	}
+
 	return dsp.NewPacketConfig(
 		19200,
-		14,
-		16,
+		symbolLength,
+		syncSymbols,
 		80,
-		"1100101110001001",
-	)
+		syncWord,
+	), nil
+}
+
+// Region describes a regional frequency plan: the channel frequencies in Hz
+// and the order in which transmitters hop through them, along with the
+// packet parameters used in that region.
+type Region struct {
+	Name     string
+	Channels []int
+
+	// HopPattern lists channel indices in hop order. It may be shorter or
+	// longer than Channels, channels absent from it are never visited.
+	HopPattern []int
+
+	// If StrictHopPattern is set, NewRegionParser rejects hop patterns which
+	// aren't a permutation of the channels. Patterns which repeat a channel
+	// mix frequency errors between hops.
+	StrictHopPattern bool
+
+	SymbolLength int
+	SyncWord     string
+}
+
+// PacketConfig returns the packet config for the region.
+func (r Region) PacketConfig() (dsp.PacketConfig, error) {
+	return NewSyncPacketConfig(r.SymbolLength, r.SyncWord)
+}
+
+// checkHopPattern returns an error if the hop pattern is empty or refers to a
+// channel which doesn't exist.
+func (r Region) checkHopPattern() error {
+	if len(r.HopPattern) == 0 {
+		return fmt.Errorf("region %s has an empty hop pattern", r.Name)
+	}
+
+	for patternIdx, channelIdx := range r.HopPattern {
+		if channelIdx < 0 || channelIdx >= len(r.Channels) {
+			return fmt.Errorf("hop %d: channel %d out of range [0, %d)", patternIdx, channelIdx, len(r.Channels))
+		}
+	}
+
+	return nil
+}
+
+// checkPermutation returns an error unless the hop pattern visits every
+// channel exactly once. The pattern must already have passed checkHopPattern.
+func (r Region) checkPermutation() error {
+	if len(r.HopPattern) != len(r.Channels) {
+		return fmt.Errorf("hop pattern has %d hops for %d channels", len(r.HopPattern), len(r.Channels))
+	}
+
+	visited := make([]bool, len(r.Channels))
+	for patternIdx, channelIdx := range r.HopPattern {
+		if visited[channelIdx] {
+			return fmt.Errorf("hop %d: channel %d repeated", patternIdx, channelIdx)
+		}
+		visited[channelIdx] = true
+	}
+
+	return nil
+}
+
+var EU = Region{
+	Name: "EU",
+	Channels: []int{
+		867500000, 867625000, 867750000, 867875000,
+		868000000, 868125000, 868250000, 868375000, 868500000,
+	},
+	HopPattern: []int{
+		0, 4, 8, 1, 5, 3, 6, 2, 7,
+	},
+	SymbolLength: 14,
+	SyncWord:     SyncWord,
+}
+
+var US = Region{
+	Name:         "US",
+	Channels:     GenerateUSChannels(),
+	HopPattern:   USHopPattern(),
+	SymbolLength: 14,
+	SyncWord:     SyncWord,
+}
+
+const (
+	usChannelCount = 51
+	usBaseFreq     = 902419338
+	// Channels are 501750.5Hz apart, keep twice the spacing so the
+	// frequencies can be computed in integers.
+	usSpacing2 = 1003501
+)
+
+// GenerateUSChannels returns the center frequencies of the 51 US channels.
+func GenerateUSChannels() []int {
+	channels := make([]int, usChannelCount)
+	for idx := range channels {
+		channels[idx] = usBaseFreq + idx*usSpacing2/2
+	}
+	return channels
+}
+
+// USHopPattern returns the order in which US transmitters hop through the
+// channels.
+func USHopPattern() []int {
+	return []int{
+		0, 19, 41, 25, 8, 47, 32, 13, 36, 22, 3, 29, 44, 16, 5, 27, 38,
+		10, 49, 21, 2, 30, 42, 14, 48, 7, 24, 34, 45, 1, 17, 39, 26, 9,
+		31, 50, 37, 12, 20, 33, 4, 43, 28, 15, 35, 6, 40, 11, 23, 46, 18,
+	}
+}
+
+const (
+	// Transmitters send a packet every (41 + id) / 16 seconds.
+	basePeriod = 2562500 * time.Microsecond
+	periodStep = 62500 * time.Microsecond
+)
+
+// TransmitterPeriod returns the interval between packets sent by the
+// transmitter with the given id.
+func TransmitterPeriod(id byte) time.Duration {
+	return basePeriod + time.Duration(id)*periodStep
 }
 
 type Parser struct {
@@ -46,45 +189,326 @@ type Parser struct {
 	ID        int
 	DwellTime time.Duration
 
-	channelCount int
-	channels     []int
+	// Options applied to every parsed message.
+	Decode DecodeOptions
+
+	// The transmitter id is extracted from a message as:
+	//     (Data[IDByte] >> IDShift) & IDMask
+	IDByte  int
+	IDShift uint
+	IDMask  byte
+
+	// If set, OnFreqEstimate is called with the discriminator samples used
+	// to estimate each packet's frequency error. The tail slice is only
+	// valid for the duration of the call.
+	OnFreqEstimate func(channelIdx int, tail []float64, estimate int)
+
+	// If IdleTimeout is non-zero, Stream calls OnIdle each time IdleTimeout
+	// passes without a message being sent.
+	IdleTimeout time.Duration
+	OnIdle      func()
+
+	// Sensor rotations expected from each transmitter id. Messages carrying a
+	// sensor type absent from their transmitter's rotation are marked
+	// Suspect. Ids without a rotation aren't checked.
+	Rotations map[byte][]Sensor
+
+	// If not empty, only messages with these sensor types are returned by
+	// Parse. Other packets still count towards reception stats and frequency
+	// error.
+	AcceptSensors map[Sensor]bool
+
+	// Number of recent expected packets LinkQuality is computed over.
+	LinkWindow int
+
+	// Frequency error is estimated from a packet's tail as:
+	//     -(FreqErrBaseOffset + mean(tail) * SampleRate * FreqErrScale)
+	// The defaults suit the discriminator's output in radians and the tail's
+	// zero symbols sitting 9600Hz below center.
+	FreqErrBaseOffset float64
+	FreqErrScale      float64
+
+	// MaxFreqStep limits how far a single packet may move the frequency
+	// error, in Hz. Zero means unlimited.
+	MaxFreqStep int
+
+	// When AdaptiveDwell is set, the dwell on each channel grows by DwellStep
+	// for every miss and shrinks by DwellStep for every reception, bounded by
+	// MinDwell and MaxDwell.
+	AdaptiveDwell      bool
+	DwellStep          time.Duration
+	MinDwell, MaxDwell time.Duration
+
+	// Channels which miss DisableAfter consecutive packets are marked
+	// Disabled by NextHop until ChannelCooldown has elapsed. Zero never
+	// disables.
+	DisableAfter    int
+	ChannelCooldown time.Duration
+
+	// IsLocked becomes true once LockAfter consecutive hops have received a
+	// packet from the transmitter, and false again after UnlockAfter
+	// consecutive misses.
+	LockAfter   int
+	UnlockAfter int
+
+	// Messages are marked Stuck once their sensor has decoded the same value
+	// StuckCount times in a row over at least StuckDuration, a common sign of
+	// a failed sensor. Zero StuckCount disables detection.
+	StuckCount    int
+	StuckDuration time.Duration
+
+	// Resync selects how RandHop picks a channel to wait on. Each
+	// consecutive resync without a reception waits ResyncBackoff longer, see
+	// ResyncDwell.
+	Resync        ResyncStrategy
+	ResyncBackoff time.Duration
+
+	// ValidatePlan flags channels visited PlanMinVisits times without a
+	// packet, and channels whose frequency error is more than
+	// PlanFreqErrTolerance Hz from the median of the measured channels, once
+	// at least three have been measured.
+	PlanMinVisits        int
+	PlanFreqErrTolerance int
+
+	// Events older than StatsRetention are discarded and don't count towards
+	// RecentStats.
+	StatsRetention time.Duration
+
+	// When RepeatWindow is non-zero Parse holds each reading for
+	// RepeatWindow, counting the channels which deliver it again instead of
+	// returning duplicates. Held readings are returned by the first Parse
+	// after their window has passed, or by FlushRepeats.
+	RepeatWindow time.Duration
+
+	// When PoolBuffers is set Parse takes message buffers from a pool and
+	// reuses its scratch buffer between calls. Each message returned owns
+	// its Data until it is passed to Release, after which neither the
+	// message nor copies of it may be used. Messages never released are
+	// left to the garbage collector, the parser keeps no reference to them.
+	// Readings held for RepeatWindow are owned by the parser until Parse or
+	// FlushRepeats returns them, repeats of a held reading are released by
+	// the parser itself.
+	PoolBuffers bool
+
+	// Malformed selects what Parse does with packets which pass the checksum
+	// but aren't the length of a message.
+	Malformed MalformedPolicy
+
+	// Capacity of the channel returned by Events.
+	EventBuffer int
+
+	// If set, Logf is called with internal events: checksum failures,
+	// malformed packets, hops, resyncs and disabled channels.
+	Logf func(format string, args ...interface{})
+
+	region Region
+
+	channelCount   int
+	channels       []int
+	channelRegions []string
 
 	hopIdx     int
 	hopPattern []int
 
 	currentFreqErr int
 	channelFreqErr map[int]int
+	freqErrDeltas  map[int][]int
+	freqErrAt      map[int]time.Time
+
+	channelDwell map[int]time.Duration
+
+	channelMisses map[int]int
+	disabled      map[int]time.Time
+
+	channelStats map[int]ChannelStats
+	linkHistory  map[byte][]bool
+	arrivals     map[byte]arrivalTiming
+	recentEvents []parseEvent
+
+	// Sample clock for arrival times, started by the first block.
+	samples Timeline
+
+	paused bool
+
+	locked               bool
+	lockHits, lockMisses int
+
+	resyncs       int
+	resyncChannel int
+
+	rotationSlots map[byte]int
+	sensorHistory map[byte][]Sensor
+
+	stuckRuns map[sensorKey]stuckRun
+
+	buffers *sync.Pool
+	scratch []byte
+
+	repeats []heldRepeat
+
+	events chan Event
+
+	now func() time.Time
 }
 
+// NewParser returns a parser for the EU region.
 func NewParser(symbolLength, id int) (p Parser) {
-	p.Cfg = NewPacketConfig(symbolLength)
-	p.Demodulator = dsp.NewDemodulator(&p.Cfg)
-	p.CRC = crc.NewCRC("CCITT-16", 0, 0x1021, 0)
+	region := EU
+	region.SymbolLength = symbolLength
 
-	p.channels = []int{
-		867500000, 867625000, 867750000, 867875000,
-                868000000, 868125000, 868250000, 868375000, 868500000,
+	p, _ = NewRegionParser(region, id)
+	return p
+}
+
+// NewRegionParser returns a parser using the region's frequency plan and
+// packet config.
+func NewRegionParser(region Region, id int) (p Parser, err error) {
+	p.Cfg, err = region.PacketConfig()
+	if err != nil {
+		return p, err
+	}
+	if err := region.checkHopPattern(); err != nil {
+		return p, err
 	}
+	if region.StrictHopPattern {
+		if err := region.checkPermutation(); err != nil {
+			return p, err
+		}
+	}
+	p.Demodulator = dsp.NewDemodulator(&p.Cfg)
+	p.CRC = davisCRC
+
+	p.region = region
+	p.channels = append([]int(nil), p.region.Channels...)
 	p.channelCount = len(p.channels)
 
-	p.hopIdx = rand.Intn(p.channelCount)
-	p.hopPattern = []int{
-		0, 4, 8, 1, 5, 3, 6, 2, 7,
-	}
+	p.hopPattern = append([]int(nil), p.region.HopPattern...)
+	p.hopIdx = rand.Intn(len(p.hopPattern))
 
 	p.channelFreqErr = make(map[int]int)
+	p.freqErrDeltas = make(map[int][]int)
+	p.freqErrAt = make(map[int]time.Time)
+	p.channelDwell = make(map[int]time.Duration)
+	p.channelMisses = make(map[int]int)
+	p.disabled = make(map[int]time.Time)
+	p.channelStats = make(map[int]ChannelStats)
+	p.linkHistory = make(map[byte][]bool)
+	p.arrivals = make(map[byte]arrivalTiming)
+	p.samples = NewTimeline(time.Time{}, p.Cfg.SampleRate)
+	p.rotationSlots = make(map[byte]int)
+	p.sensorHistory = make(map[byte][]Sensor)
+	p.stuckRuns = make(map[sensorKey]stuckRun)
+	p.buffers = &sync.Pool{New: func() interface{} { return new([]byte) }}
+	p.now = time.Now
 
 	p.ID = id
+	p.IDMask = 0xF
+
 	p.DwellTime = 60000 * time.Microsecond
-	p.DwellTime += time.Duration(p.ID) * 62500 * time.Microsecond
+	p.DwellTime += time.Duration(p.ID) * periodStep
 
-	return
+	p.DwellStep = p.DwellTime >> 3
+	p.MinDwell = p.DwellTime
+	p.MaxDwell = p.DwellTime << 1
+
+	p.ChannelCooldown = time.Minute
+	p.LockAfter = 3
+	p.UnlockAfter = 3
+
+	p.FreqErrBaseOffset = 9600
+	p.FreqErrScale = 1 / (2 * math.Pi)
+	p.MaxFreqStep = 2000
+	p.LinkWindow = 32
+	p.StatsRetention = time.Hour
+	p.PlanMinVisits = 10
+	p.PlanFreqErrTolerance = 5000
+	p.EventBuffer = 64
+
+	return p, nil
+}
+
+// NewMultiRegionParser returns a parser which hops through the channels of
+// every region in turn, for discovering which plan a station uses. Messages
+// are tagged with the region whose channel they arrived on. The regions must
+// share packet parameters.
+func NewMultiRegionParser(regions []Region, id int) (p Parser, err error) {
+	if len(regions) == 0 {
+		return p, fmt.Errorf("no regions")
+	}
+
+	var union Region
+	var names []string
+	var channelRegions []string
+	for _, region := range regions {
+		if region.SymbolLength != regions[0].SymbolLength || region.SyncWord != regions[0].SyncWord {
+			return p, fmt.Errorf("region %s packet parameters differ from %s", region.Name, regions[0].Name)
+		}
+
+		for _, channelIdx := range region.HopPattern {
+			union.HopPattern = append(union.HopPattern, len(union.Channels)+channelIdx)
+		}
+		union.Channels = append(union.Channels, region.Channels...)
+		for range region.Channels {
+			channelRegions = append(channelRegions, region.Name)
+		}
+		names = append(names, region.Name)
+	}
+	union.Name = strings.Join(names, "+")
+	union.SymbolLength = regions[0].SymbolLength
+	union.SyncWord = regions[0].SyncWord
+
+	p, err = NewRegionParser(union, id)
+	p.channelRegions = channelRegions
+	return p, err
+}
+
+// ParserConfig is a snapshot of a parser's static configuration.
+type ParserConfig struct {
+	Region     string
+	Channels   []int
+	HopPattern []int
+
+	CRCName    string
+	CRCInit    uint16
+	CRCPoly    uint16
+	CRCResidue uint16
+
+	ID           int
+	DwellTime    time.Duration
+	SyncWord     string
+	SymbolLength int
+	SampleRate   int
+}
+
+// Config returns a snapshot of the parser's configuration.
+func (p *Parser) Config() ParserConfig {
+	return ParserConfig{
+		Region:     p.region.Name,
+		Channels:   append([]int(nil), p.channels...),
+		HopPattern: append([]int(nil), p.hopPattern...),
+
+		CRCName:    p.CRC.Name,
+		CRCInit:    p.CRC.Init,
+		CRCPoly:    p.CRC.Poly,
+		CRCResidue: p.CRC.Residue,
+
+		ID:           p.ID,
+		DwellTime:    p.DwellTime,
+		SyncWord:     p.Cfg.Preamble,
+		SymbolLength: p.Cfg.SymbolLength,
+		SampleRate:   p.Cfg.SampleRate,
+	}
 }
 
 type Hop struct {
 	ChannelIdx  int
 	ChannelFreq int
 	FreqError   int
+
+	// Disabled is set when NextHop lands on a disabled channel. The hop
+	// still takes its dwell slot so the pattern stays in step with the
+	// transmitter, but needn't be tuned to and Missed doesn't count it.
+	Disabled bool
 }
 
 func (h Hop) String() string {
@@ -107,64 +531,815 @@ func (p *Parser) hop() (h Hop) {
 	return h
 }
 
-// Increment the pattern index and return the new channel's parameters.
+// Increment the pattern index and return the new channel's parameters. Hops
+// to disabled channels are marked Disabled rather than skipped, since the
+// transmitter still visits them. While paused the current channel's
+// parameters are returned.
 func (p *Parser) NextHop() Hop {
-	p.hopIdx = (p.hopIdx + 1) % p.channelCount
-	return p.hop()
+	if p.paused {
+		return p.hop()
+	}
+
+	p.hopIdx = (p.hopIdx + 1) % len(p.hopPattern)
+
+	h := p.hop()
+	h.Disabled = p.isDisabled(h.ChannelIdx)
+	p.logf("hop: %s", h)
+	p.emitHop(EventHop, h)
+	return h
+}
+
+// logf calls Logf if it is set.
+func (p *Parser) logf(format string, args ...interface{}) {
+	if p.Logf != nil {
+		p.Logf(format, args...)
+	}
+}
+
+// SetClock replaces the clock used for timestamps and timers, for testing.
+// A nil clock restores time.Now.
+func (p *Parser) SetClock(now func() time.Time) {
+	if now == nil {
+		now = time.Now
+	}
+	p.now = now
+}
+
+// Now returns the current time on the parser's clock, see SetClock.
+func (p *Parser) Now() time.Time {
+	return p.now()
+}
+
+// Pause freezes the hop sequence on the current channel until Resume is
+// called.
+func (p *Parser) Pause() {
+	p.paused = true
+}
+
+// Resume continues hopping from where Pause left off.
+func (p *Parser) Resume() {
+	p.paused = false
+}
+
+// HopTo jumps to the given index of the hop pattern and returns the channel's
+// parameters.
+func (p *Parser) HopTo(patternIdx int) (Hop, error) {
+	if patternIdx < 0 || patternIdx >= len(p.hopPattern) {
+		return Hop{}, fmt.Errorf("hop pattern index %d out of range [0, %d)", patternIdx, len(p.hopPattern))
+	}
+
+	p.hopIdx = patternIdx
+
+	h := p.hop()
+	p.logf("hop: %s", h)
+	p.emitHop(EventHop, h)
+	return h, nil
+}
+
+// CorrectedHopFrequencies returns the frequency of each hop in pattern order,
+// corrected by its channel's frequency error. Unvisited channels are
+// uncorrected.
+func (p *Parser) CorrectedHopFrequencies() []int {
+	freqs := make([]int, len(p.hopPattern))
+	for idx, channelIdx := range p.hopPattern {
+		freqs[idx] = p.channels[channelIdx] + p.channelFreqErr[channelIdx]
+	}
+	return freqs
+}
+
+// StartOffset returns the hop pattern index receiver index of receivers
+// should start from so that together they are spread evenly across the
+// pattern. Pass the result to HopTo.
+func (p *Parser) StartOffset(receivers, index int) (int, error) {
+	if receivers < 1 || receivers > len(p.hopPattern) {
+		return 0, fmt.Errorf("receiver count %d out of range [1, %d]", receivers, len(p.hopPattern))
+	}
+	if index < 0 || index >= receivers {
+		return 0, fmt.Errorf("receiver index %d out of range [0, %d)", index, receivers)
+	}
+
+	return index * len(p.hopPattern) / receivers, nil
+}
+
+// PredictChannel returns the channel the parser's transmitter is expected on
+// at now, given it was on refChannelIdx at ref, by counting the hops its
+// period allows between the two. Returns -1 if refChannelIdx isn't in the hop
+// pattern.
+func (p *Parser) PredictChannel(ref time.Time, refChannelIdx int, now time.Time) int {
+	return p.PredictChannelFor(byte(p.ID), ref, refChannelIdx, now)
+}
+
+// PredictChannelFor is PredictChannel for the transmitter with the given id,
+// such as an anemometer transmitter alongside the ISS, hopping at its own
+// period.
+func (p *Parser) PredictChannelFor(id byte, ref time.Time, refChannelIdx int, now time.Time) int {
+	refIdx := p.patternIndex(refChannelIdx)
+	if refIdx == -1 {
+		return -1
+	}
+
+	elapsed, period := now.Sub(ref), TransmitterPeriod(id)
+	hops := elapsed / period
+	if elapsed%period < 0 {
+		hops--
+	}
+
+	hops %= time.Duration(len(p.hopPattern))
+	return p.hopPattern[(refIdx+int(hops)+len(p.hopPattern))%len(p.hopPattern)]
+}
+
+// isDisabled reports whether a channel is disabled, re-enabling it if its
+// cooldown has elapsed.
+func (p *Parser) isDisabled(channelIdx int) bool {
+	disabledAt, exists := p.disabled[channelIdx]
+	if !exists {
+		return false
+	}
+
+	if p.now().Sub(disabledAt) >= p.ChannelCooldown {
+		delete(p.disabled, channelIdx)
+		p.channelMisses[channelIdx] = 0
+		return false
+	}
+
+	return true
+}
+
+// DisabledChannels returns the indexes of channels currently disabled, in
+// ascending order.
+func (p *Parser) DisabledChannels() (channels []int) {
+	for channelIdx := range p.channels {
+		if p.isDisabled(channelIdx) {
+			channels = append(channels, channelIdx)
+		}
+	}
+	return channels
+}
+
+// channelRegion returns the name of the region a channel belongs to.
+func (p *Parser) channelRegion(channelIdx int) string {
+	if channelIdx < len(p.channelRegions) {
+		return p.channelRegions[channelIdx]
+	}
+	return p.region.Name
 }
 
-// Randomize the pattern index and return the new channel's parameters.
+// patternIndex returns the first index of the channel in the hop pattern, or
+// -1 if the pattern doesn't visit it.
+func (p *Parser) patternIndex(channelIdx int) int {
+	for idx, c := range p.hopPattern {
+		if c == channelIdx {
+			return idx
+		}
+	}
+	return -1
+}
+
+// ResyncStrategy selects the channel RandHop resyncs to.
+type ResyncStrategy int
+
+const (
+	// Resync to a random position in the hop pattern.
+	ResyncRandom ResyncStrategy = iota
+	// Resync to each channel in turn, in order of channel index.
+	ResyncSequential
+)
+
+// MalformedPolicy selects how Parse handles packets which pass the checksum
+// but are the wrong length, such as truncated captures.
+type MalformedPolicy int
+
+const (
+	// Drop malformed packets.
+	MalformedDrop MalformedPolicy = iota
+	// Return malformed packets as messages with Malformed set. Short packets
+	// are padded with zeros.
+	MalformedEmit
+)
+
+// Resync to a channel chosen by the parser's Resync strategy and return the
+// new channel's parameters. While paused the current channel's parameters are
+// returned.
 func (p *Parser) RandHop() Hop {
-	p.hopIdx = rand.Intn(p.channelCount)
-	return p.hop()
+	if p.paused {
+		return p.hop()
+	}
+
+	switch p.Resync {
+	case ResyncSequential:
+		for n := 0; n < p.channelCount; n++ {
+			patternIdx := p.patternIndex(p.resyncChannel)
+			p.resyncChannel = (p.resyncChannel + 1) % p.channelCount
+			if patternIdx != -1 {
+				p.hopIdx = patternIdx
+				break
+			}
+		}
+	default:
+		p.hopIdx = rand.Intn(len(p.hopPattern))
+	}
+	p.resyncs++
+
+	h := p.hop()
+	p.logf("resync: %s", h)
+	p.emitHop(EventResync, h)
+	return h
+}
+
+// resyncSlots is the number of dwell periods waited after a resync, one full
+// cycle of the 51 channel US pattern plus one hop. Shorter patterns keep the
+// same wait.
+const resyncSlots = 52
+
+// ResyncDwell returns how long to wait on a channel after RandHop: resyncSlots
+// dwell periods, and ResyncBackoff for each earlier resync since the last
+// packet was received.
+func (p *Parser) ResyncDwell() time.Duration {
+	dwell := resyncSlots * p.DwellTime
+	if p.resyncs > 1 {
+		dwell += time.Duration(p.resyncs-1) * p.ResyncBackoff
+	}
+	return dwell
+}
+
+// FrequencyPlan describes the frequency plan in use: region, each channel's
+// frequency and current frequency error, and the hop pattern. Intended for
+// inclusion in bug reports.
+func (p *Parser) FrequencyPlan() string {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "Region: %s\n", p.region.Name)
+	fmt.Fprintf(&buf, "Channels: %d\n", p.channelCount)
+	for idx, freq := range p.channels {
+		fmt.Fprintf(&buf, "  %2d: %d FreqError:%d\n", idx, freq, p.channelFreqErr[idx])
+	}
+	fmt.Fprintf(&buf, "HopPattern: %v\n", p.hopPattern)
+
+	return buf.String()
+}
+
+// CurrentDwell returns the dwell time for the current channel. Without
+// AdaptiveDwell this is always DwellTime.
+func (p *Parser) CurrentDwell() time.Duration {
+	if !p.AdaptiveDwell {
+		return p.DwellTime
+	}
+
+	dwell, exists := p.channelDwell[p.hopPattern[p.hopIdx]]
+	if !exists {
+		return p.DwellTime
+	}
+	return dwell
+}
+
+// Missed records that the dwell time expired on the current channel without
+// receiving a packet. Misses on disabled channels aren't counted.
+func (p *Parser) Missed() {
+	channelIdx := p.hopPattern[p.hopIdx]
+	if p.isDisabled(channelIdx) {
+		return
+	}
+
+	p.adjustDwell(p.DwellStep)
+
+	stats := p.channelStats[channelIdx]
+	stats.Missed++
+	p.channelStats[channelIdx] = stats
+
+	p.recordLink(byte(p.ID), false)
+	p.recordEvent(eventMissed, byte(p.ID))
+	p.updateLock(false)
+
+	p.channelMisses[channelIdx]++
+	if p.DisableAfter > 0 && p.channelMisses[channelIdx] >= p.DisableAfter {
+		if _, exists := p.disabled[channelIdx]; !exists {
+			p.disabled[channelIdx] = p.now()
+			p.logf("channel %d disabled after %d misses", channelIdx, p.channelMisses[channelIdx])
+		}
+	}
+}
+
+// IsLocked reports whether the parser is following the transmitter's hops,
+// see LockAfter.
+func (p *Parser) IsLocked() bool {
+	return p.locked
+}
+
+func (p *Parser) updateLock(received bool) {
+	if received {
+		p.lockHits, p.lockMisses = p.lockHits+1, 0
+		if p.lockHits >= p.LockAfter {
+			p.locked = true
+		}
+		return
+	}
+
+	p.lockHits, p.lockMisses = 0, p.lockMisses+1
+	if p.lockMisses >= p.UnlockAfter {
+		p.locked = false
+	}
+}
+
+func (p *Parser) adjustDwell(step time.Duration) {
+	if !p.AdaptiveDwell {
+		return
+	}
+
+	dwell := p.CurrentDwell() + step
+	if dwell < p.MinDwell {
+		dwell = p.MinDwell
+	}
+	if dwell > p.MaxDwell {
+		dwell = p.MaxDwell
+	}
+	p.channelDwell[p.hopPattern[p.hopIdx]] = dwell
+}
+
+// FreqErrorForChannel returns the frequency error stored for a channel and
+// whether the channel has been measured yet.
+func (p *Parser) FreqErrorForChannel(channelIdx int) (int, bool) {
+	freqErr, exists := p.channelFreqErr[channelIdx]
+	return freqErr, exists
+}
+
+// Number of recent frequency error updates IsConverged considers.
+const convergenceUpdates = 3
+
+// setFreqErr stores a channel's frequency error, keeping track of how much it
+// changed.
+func (p *Parser) setFreqErr(channelIdx, freqErr int) {
+	if prev, exists := p.channelFreqErr[channelIdx]; exists {
+		deltas := append(p.freqErrDeltas[channelIdx], freqErr-prev)
+		if len(deltas) > convergenceUpdates {
+			deltas = deltas[len(deltas)-convergenceUpdates:]
+		}
+		p.freqErrDeltas[channelIdx] = deltas
+	}
+	p.channelFreqErr[channelIdx] = freqErr
+	p.freqErrAt[channelIdx] = p.now()
+}
+
+// FreqErrorAge returns how long ago a channel's frequency error was last
+// measured, or -1 if it hasn't been measured since the parser was created or
+// its state loaded.
+func (p *Parser) FreqErrorAge(channelIdx int) time.Duration {
+	at, exists := p.freqErrAt[channelIdx]
+	if !exists {
+		return -1
+	}
+	return p.now().Sub(at)
+}
+
+// IsConverged reports whether the frequency error of every visited channel
+// has changed by less than threshold Hz over each of its last few updates.
+func (p *Parser) IsConverged(threshold int) bool {
+	if len(p.channelFreqErr) == 0 {
+		return false
+	}
+
+	for channelIdx := range p.channelFreqErr {
+		deltas := p.freqErrDeltas[channelIdx]
+		if len(deltas) < convergenceUpdates {
+			return false
+		}
+		for _, delta := range deltas {
+			if delta >= threshold || -delta >= threshold {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// estimateFreqError looks at the packet's tail to determine frequency error
+// between transmitter and receiver. Returns false if the tail lies outside the
+// discriminator's buffer or the estimate isn't finite.
+func (p *Parser) estimateFreqError(pkt dsp.Packet) (int, bool) {
+	lower := pkt.Idx + 8*p.Cfg.SymbolLength
+	upper := pkt.Idx + 24*p.Cfg.SymbolLength
+	if upper > len(p.Demodulator.Discriminated) {
+		upper = len(p.Demodulator.Discriminated)
+	}
+	if lower < 0 || lower >= upper {
+		return 0, false
+	}
+	tail := p.Demodulator.Discriminated[lower:upper]
+
+	var mean float64
+	for _, sample := range tail {
+		mean += sample
+	}
+	mean /= float64(len(tail))
+
+	// The tail is a series of zero symbols. The driminator's output is
+	// measured in radians.
+	freqError := p.FreqErrBaseOffset + mean*float64(p.Cfg.SampleRate)*p.FreqErrScale
+	if math.IsNaN(freqError) || math.IsInf(freqError, 0) {
+		return 0, false
+	}
+
+	if p.OnFreqEstimate != nil {
+		p.OnFreqEstimate(p.hopPattern[p.hopIdx], tail, -int(freqError))
+	}
+
+	return -int(freqError), true
 }
 
 // Given a list of packets, check them for validity and ignore duplicates,
 // return a list of parsed messages.
 func (p *Parser) Parse(pkts []dsp.Packet) (msgs []Message) {
-	seen := make(map[string]bool)
+	seen := make(map[uint64]bool)
 
+	received := false
 	for _, pkt := range pkts {
-		// Bit order over-the-air is reversed.
-		for idx, b := range pkt.Data {
-			pkt.Data[idx] = SwapBitOrder(b)
+		// Bit order over-the-air is reversed. Swap into a copy so the
+		// caller's packet is left as it was received.
+		var data []byte
+		if p.PoolBuffers {
+			p.scratch = append(p.scratch[:0], pkt.Data...)
+			data = p.scratch
+		} else {
+			data = make([]byte, len(pkt.Data))
 		}
+		SwapBitOrderSlice(data, pkt.Data)
+		pkt.Data = data
 
 		// Keep track of duplicate packets.
-		s := string(pkt.Data)
-		if seen[s] {
+		h := fnv64a(pkt.Data)
+		if seen[h] {
 			continue
 		}
-		seen[s] = true
+		seen[h] = true
 
 		// If the checksum fails, bail.
-		if p.Checksum(pkt.Data[2:]) != 0 {
+		if !p.Valid(pkt.Data[2:]) {
+			p.logf("checksum failed: %02X", pkt.Data[2:])
+			p.emitData(EventCRCFailure, pkt.Data[2:])
+			p.recordEvent(eventCRCFailure, p.extractID(pkt.Data[2:]))
 			continue
 		}
 
-		// Look at the packet's tail to determine frequency error between
-		// transmitter and receiver.
-		lower := pkt.Idx + 8*p.Cfg.SymbolLength
-		upper := pkt.Idx + 24*p.Cfg.SymbolLength
-		tail := p.Demodulator.Discriminated[lower:upper]
+		malformed := len(pkt.Data) != 2+messageLength
+		if malformed {
+			p.logf("malformed packet: %02X", pkt.Data[2:])
+			if p.Malformed == MalformedDrop {
+				continue
+			}
+			pkt.Data = padPacket(pkt.Data)
+		}
+		p.recordEvent(eventValid, p.extractID(pkt.Data[2:]))
+		p.emitData(EventReceived, pkt.Data[2:])
+
+		if freqError, ok := p.estimateFreqError(pkt); ok {
+			if p.MaxFreqStep > 0 {
+				if freqError > p.MaxFreqStep {
+					freqError = p.MaxFreqStep
+				}
+				if freqError < -p.MaxFreqStep {
+					freqError = -p.MaxFreqStep
+				}
+			}
 
-		var mean float64
-		for _, sample := range tail {
-			mean += sample
+			// Set the current channel's frequency error.
+			p.setFreqErr(p.hopPattern[p.hopIdx], p.currentFreqErr+freqError)
+
+			// Update the current frequency error.
+			p.currentFreqErr += freqError
 		}
-		mean /= float64(len(tail))
 
-		// The tail is a series of zero symbols. The driminator's output is
-		// measured in radians.
-		freqError := -int(9600 + (mean*float64(p.Cfg.SampleRate))/(2*math.Pi))
+		p.adjustDwell(-p.DwellStep)
+		p.channelMisses[p.hopPattern[p.hopIdx]] = 0
+		p.resyncs = 0
 
-		// Set the current channel's frequency error.
-		p.channelFreqErr[p.hopPattern[p.hopIdx]] = p.currentFreqErr + freqError
+		stats := p.channelStats[p.hopPattern[p.hopIdx]]
+		stats.Received++
+		p.channelStats[p.hopPattern[p.hopIdx]] = stats
 
-		// Update the current frequency error.
-		p.currentFreqErr += freqError
+		p.recordLink(p.extractID(pkt.Data[2:]), true)
+		if p.extractID(pkt.Data[2:]) == byte(p.ID) {
+			received = true
+		}
+
+		p.recordSensor(p.extractID(pkt.Data[2:]), Sensor(pkt.Data[2]>>4))
+
+		// Drop unwanted sensor types before decoding.
+		if len(p.AcceptSensors) > 0 && !p.AcceptSensors[Sensor(pkt.Data[2]>>4)] {
+			continue
+		}
+
+		msg := p.newMessage(pkt)
+		msg.Time = p.now()
+		msg.ID = p.extractID(msg.Data)
+		msg.Options = p.Decode
+		msg.Region = p.channelRegion(p.hopPattern[p.hopIdx])
+		msg.Suspect = !p.inRotation(msg)
+		msg.rotationSlot = p.nextRotationSlot(msg)
+		msg.Stuck = p.isStuck(msg)
+		msg.Malformed = malformed
+		p.recordArrival(msg.ID, p.sampleTime(pkt.Idx))
+
+		if p.RepeatWindow > 0 {
+			p.holdRepeat(msg, p.hopPattern[p.hopIdx])
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
 
-		msgs = append(msgs, NewMessage(pkt))
+	if received {
+		p.updateLock(true)
+	}
+	if p.RepeatWindow > 0 {
+		msgs = append(msgs, p.expiredRepeats()...)
+	}
+
+	return
+}
+
+// padPacket pads a short packet with zeros so decoders don't read past the
+// end.
+func padPacket(data []byte) []byte {
+	for len(data) < 2+messageLength {
+		data = append(data, 0)
+	}
+	return data
+}
+
+// newMessage decodes the packet into a pooled buffer if PoolBuffers is set.
+func (p *Parser) newMessage(pkt dsp.Packet) Message {
+	if !p.PoolBuffers {
+		return NewMessage(pkt)
+	}
+
+	// The pool holds *[]byte so that Put doesn't allocate a slice header,
+	// the message keeps the pointer to return its buffer with.
+	pooled := p.buffers.Get().(*[]byte)
+	msg := Message{Packet: dsp.Packet{Data: *pooled}}
+	if err := DecodeInto(pkt, &msg); err != nil {
+		return NewMessage(pkt)
+	}
+	msg.pooled = pooled
+	return msg
+}
+
+// Release returns the message's buffer to the pool if it was taken from one,
+// see PoolBuffers. The message must have been returned by Parse or
+// FlushRepeats and not released already.
+func (p *Parser) Release(m Message) {
+	if m.pooled == nil {
+		return
+	}
+	*m.pooled = m.Data[:0]
+	p.buffers.Put(m.pooled)
+}
+
+// Valid reports whether a message's data, following the sync word, passes the
+// checksum.
+func (p *Parser) Valid(data []byte) bool {
+	return len(data) > 2 && p.Checksum(data) == 0
+}
+
+// The CRC transmitters append to each payload.
+var davisCRC = crc.NewCRC("CCITT-16", 0, 0x1021, 0)
+
+// Checksum returns the CRC of data as computed by Davis transmitters, the same
+// CRC used by Parser.
+func Checksum(data []byte) uint16 {
+	return davisCRC.Checksum(data)
+}
+
+// AppendChecksum returns a copy of the payload with its checksum appended,
+// making it pass Valid. The payload's backing array is never written to.
+// Useful for crafting packets.
+func (p *Parser) AppendChecksum(payload []byte) []byte {
+	checksum := p.Checksum(payload)
+	return append(payload[:len(payload):len(payload)], byte(checksum>>8), byte(checksum))
+}
+
+// extractID returns the transmitter id from a message's data.
+func (p *Parser) extractID(data []byte) byte {
+	if p.IDByte < 0 || p.IDByte >= len(data) {
+		return 0
+	}
+	return (data[p.IDByte] >> p.IDShift) & p.IDMask
+}
+
+// fnv64a returns the 64-bit FNV-1a hash of data.
+func fnv64a(data []byte) uint64 {
+	const (
+		offset = 14695981039346656037
+		prime  = 1099511628211
+	)
+
+	h := uint64(offset)
+	for _, b := range data {
+		h ^= uint64(b)
+		h *= prime
+	}
+	return h
+}
+
+// Demodulate demodulates a block of samples, see dsp.Demodulator, and advances
+// the sample clock past it.
+func (p *Parser) Demodulate(input []byte) []dsp.Packet {
+	p.startSamples()
+	p.samples.Advance(len(input) >> 1)
+	return p.Demodulator.Demodulate(input)
+}
+
+// startSamples starts the sample clock at the current time if it isn't
+// running yet.
+func (p *Parser) startSamples() {
+	if p.samples.Start.IsZero() {
+		p.samples.Start = p.now()
+	}
+}
+
+// sampleTime returns the sample clock's time of a packet found at idx in the
+// demodulator's buffer, which ends with the latest block. Unlike the time a
+// message is parsed, it doesn't depend on how promptly blocks are read.
+func (p *Parser) sampleTime(idx int) time.Time {
+	p.startSamples()
+	return p.samples.Time(idx - p.Cfg.BufferLength)
+}
+
+// ParseWith parses packets found in previously demodulated data, using
+// discriminated in place of the demodulator's own output when estimating
+// frequency error. This allows the complete Parse path to be driven from
+// canned data.
+func (p *Parser) ParseWith(pkts []dsp.Packet, discriminated []float64) []Message {
+	for idx := range p.Demodulator.Discriminated {
+		p.Demodulator.Discriminated[idx] = 0
+	}
+	copy(p.Demodulator.Discriminated, discriminated)
+
+	return p.Parse(pkts)
+}
+
+// ParseGrouped parses the packets like Parse and groups the messages by
+// sensor type, in order of arrival.
+func (p *Parser) ParseGrouped(pkts []dsp.Packet) map[Sensor][]Message {
+	groups := make(map[Sensor][]Message)
+	for _, msg := range p.Parse(pkts) {
+		groups[msg.Sensor] = append(groups[msg.Sensor], msg)
+	}
+	return groups
+}
+
+// ISSRotation is the order in which a Vantage Pro2 ISS sends its sensor
+// readings, every other packet carries rain.
+var ISSRotation = []Sensor{
+	Temperature, Rain, RainRate, Rain, UVIndex, Rain, SolarRadiation, Rain,
+	WindGustSpeed, Rain, Humidity, Rain, SuperCapVoltage, Rain, Light, Rain,
+}
+
+// inRotation reports whether the message's sensor type is part of its
+// transmitter's rotation, or true when no rotation is known.
+func (p *Parser) inRotation(msg Message) bool {
+	rotation, exists := p.Rotations[msg.ID]
+	if !exists {
+		return true
+	}
+
+	for _, sensor := range rotation {
+		if sensor == msg.Sensor {
+			return true
+		}
+	}
+	return false
+}
+
+// nextRotationSlot returns the slot of the transmitter's rotation the message
+// occupies: the first slot carrying the message's sensor type after the slot
+// of the previous message from the same transmitter. Returns -1 if the
+// transmitter has no rotation or the sensor isn't part of it.
+func (p *Parser) nextRotationSlot(msg Message) int {
+	rotation := p.Rotations[msg.ID]
+
+	start := 0
+	if last, exists := p.rotationSlots[msg.ID]; exists {
+		start = last + 1
+	}
+
+	for n := range rotation {
+		slot := (start + n) % len(rotation)
+		if rotation[slot] == msg.Sensor {
+			p.rotationSlots[msg.ID] = slot
+			return slot
+		}
+	}
+
+	return -1
+}
+
+// Longest rotation ObservedRotation can recover.
+const maxRotation = 32
+
+// recordSensor keeps the sensor types of a transmitter's recent packets, long
+// enough to hold the longest rotation twice.
+func (p *Parser) recordSensor(id byte, sensor Sensor) {
+	history := append(p.sensorHistory[id], sensor)
+	if len(history) > 2*maxRotation {
+		history = history[len(history)-2*maxRotation:]
+	}
+	p.sensorHistory[id] = history
+}
+
+// ObservedRotation returns the transmitter's sensor rotation in the order its
+// last rotation was received: the shortest sequence of sensor types its
+// recent packets have repeated twice in a row. Returns nil until a rotation
+// has been seen twice without a missed packet.
+func (p *Parser) ObservedRotation(id byte) []Sensor {
+	history := p.sensorHistory[id]
+
+	for period := 1; 2*period <= len(history); period++ {
+		tail := history[len(history)-2*period:]
+
+		repeated := true
+		for idx := 0; idx < period; idx++ {
+			if tail[idx] != tail[idx+period] {
+				repeated = false
+				break
+			}
+		}
+		if repeated {
+			return append([]Sensor(nil), tail[period:]...)
+		}
+	}
+
+	return nil
+}
+
+// BatchSummary describes a batch of received packets.
+type BatchSummary struct {
+	Packets int
+	Valid   int
+
+	// Counts of valid packets by sensor type.
+	Sensors map[Sensor]int
+
+	// Unique transmitter ids seen in valid packets, in ascending order.
+	IDs []byte
+}
+
+// CRCPassRate returns the fraction of packets which passed the checksum.
+func (s BatchSummary) CRCPassRate() float64 {
+	if s.Packets == 0 {
+		return 0
+	}
+	return float64(s.Valid) / float64(s.Packets)
+}
+
+func (s BatchSummary) String() string {
+	var sensors []string
+	for sensor, count := range s.Sensors {
+		sensors = append(sensors, fmt.Sprintf("%d %s", count, sensor))
+	}
+	sort.Strings(sensors)
+
+	return fmt.Sprintf("{Packets:%d Sensors:[%s] CRCFail:%d IDs:%v}",
+		s.Packets, strings.Join(sensors, ", "), s.Packets-s.Valid, s.IDs,
+	)
+}
+
+// Summarize checks a batch of packets without updating any parser state and
+// returns counts by sensor type, checksum failures and ids seen. Malformed
+// packets are handled as by Parse.
+func (p *Parser) Summarize(pkts []dsp.Packet) (s BatchSummary) {
+	s.Sensors = make(map[Sensor]int)
+	ids := make(map[byte]bool)
+
+	data := make([]byte, 0, p.Cfg.PacketSymbols>>3)
+	for _, pkt := range pkts {
+		s.Packets++
+
+		if cap(data) < len(pkt.Data) {
+			data = make([]byte, len(pkt.Data))
+		}
+		data = data[:len(pkt.Data)]
+		SwapBitOrderSlice(data, pkt.Data)
+
+		if !p.Valid(data[2:]) {
+			continue
+		}
+		if len(data) != 2+messageLength {
+			if p.Malformed == MalformedDrop {
+				continue
+			}
+			data = padPacket(data)
+		}
+		s.Valid++
+
+		msg := NewMessage(dsp.Packet{Idx: pkt.Idx, Data: data})
+		msg.ID = p.extractID(msg.Data)
+		s.Sensors[msg.Sensor]++
+		ids[msg.ID] = true
+	}
+
+	for id := 0; id < 256; id++ {
+		if ids[byte(id)] {
+			s.IDs = append(s.IDs, byte(id))
+		}
 	}
 
 	return
@@ -173,11 +1348,44 @@ func (p *Parser) Parse(pkts []dsp.Packet) (msgs []Message) {
 type Message struct {
 	dsp.Packet
 
+	// Time the message was parsed.
+	Time time.Time
+
 	ID     byte
 	Sensor Sensor
 
 	WindSpeed     byte
 	WindDirection byte
+
+	// Region the message was received in, see NewMultiRegionParser.
+	Region string
+
+	// Collector is the rain collector on the transmitter a Rain message is
+	// from, 0 unless a second collector is connected.
+	Collector byte
+
+	Options DecodeOptions
+
+	// Suspect is set when the sensor type isn't one the transmitter is
+	// expected to send, which suggests a corrupt packet that passed the CRC.
+	Suspect bool
+
+	// Number of channels which delivered this reading, see
+	// Parser.RepeatWindow. Repeated readings suggest a strong link.
+	RepeatCount int
+
+	// Stuck is set when the sensor has reported the same value for longer
+	// than the parser's StuckCount and StuckDuration.
+	Stuck bool
+
+	// Malformed is set when the packet passed the checksum but wasn't the
+	// length of a message, see Parser.Malformed.
+	Malformed bool
+
+	rotationSlot int
+
+	// Pool entry Data was taken from, see Parser.PoolBuffers.
+	pooled *[]byte
 }
 
 func NewMessage(pkt dsp.Packet) (m Message) {
@@ -185,11 +1393,47 @@ func NewMessage(pkt dsp.Packet) (m Message) {
 	m.Data = make([]byte, len(pkt.Data)-2)
 	copy(m.Data, pkt.Data[2:])
 
+	m.decodeHeader()
+	return m
+}
+
+// Length of a message's data: header, reading, flags and checksum.
+const messageLength = 8
+
+// DecodeInto decodes the packet into m like NewMessage, reusing m's Data
+// buffer if it is large enough.
+func DecodeInto(pkt dsp.Packet, m *Message) error {
+	if len(pkt.Data) < 2+messageLength {
+		return fmt.Errorf("packet of %d bytes is too short, want %d", len(pkt.Data), 2+messageLength)
+	}
+
+	data := m.Data[:0]
+	*m = Message{}
+	m.Idx = pkt.Idx
+	m.Data = append(data, pkt.Data[2:]...)
+
+	m.decodeHeader()
+	return nil
+}
+
+// decodeHeader sets the fields decoded from the fixed header bytes.
+func (m *Message) decodeHeader() {
 	m.ID = m.Data[0] & 0xF
 	m.Sensor = Sensor(m.Data[0] >> 4)
 	m.WindSpeed = m.Data[1]
 	m.WindDirection = m.Data[2]
-	return m
+	if m.Sensor == Rain {
+		m.Collector = m.Data[3] >> 7
+	}
+	m.RepeatCount = 1
+	m.rotationSlot = -1
+}
+
+// RotationSlot returns the message's position in its transmitter's sensor
+// rotation, or -1 if unknown. Only set by Parse for transmitters in
+// Parser.Rotations.
+func (m Message) RotationSlot() int {
+	return m.rotationSlot
 }
 
 func (m Message) String() string {
@@ -199,15 +1443,17 @@ func (m Message) String() string {
 type Sensor byte
 
 const (
-	SuperCapVoltage Sensor = 2
-	UVIndex         Sensor = 4
-	RainRate        Sensor = 5
-	SolarRadiation  Sensor = 6
-	Light           Sensor = 7
-	Temperature     Sensor = 8
-	WindGustSpeed   Sensor = 9
-	Humidity        Sensor = 0xA
-	Rain            Sensor = 0xE
+	SuperCapVoltage  Sensor = 2
+	UVIndex          Sensor = 4
+	RainRate         Sensor = 5
+	SolarRadiation   Sensor = 6
+	Light            Sensor = 7
+	Temperature      Sensor = 8
+	WindGustSpeed    Sensor = 9
+	Humidity         Sensor = 0xA
+	ExtraTemperature Sensor = 0xC
+	Rain             Sensor = 0xE
+	SoilLeaf         Sensor = 0xF
 )
 
 func (s Sensor) String() string {
@@ -228,16 +1474,60 @@ func (s Sensor) String() string {
 		return "Wind Gust Speed"
 	case Humidity:
 		return "Humidity"
+	case ExtraTemperature:
+		return "Extra Temperature"
 	case Rain:
 		return "Rain"
+	case SoilLeaf:
+		return "Soil/Leaf"
 	default:
 		return fmt.Sprintf("Unknown(0x%0X)", byte(s))
 	}
 }
 
+// ParseSensor is the inverse of Sensor.String. Names are matched without
+// regard to case, unknown sensors are accepted in the form "Unknown(0x..)".
+func ParseSensor(name string) (Sensor, error) {
+	name = strings.TrimSpace(name)
+
+	lower := strings.ToLower(name)
+	if strings.HasPrefix(lower, "unknown(0x") && strings.HasSuffix(lower, ")") {
+		val, err := strconv.ParseUint(lower[len("unknown(0x"):len(lower)-1], 16, 8)
+		if err != nil {
+			return 0, fmt.Errorf("invalid sensor %q: %s", name, err)
+		}
+		return Sensor(val), nil
+	}
+
+	for val := 0; val < 256; val++ {
+		if strings.EqualFold(Sensor(val).String(), name) {
+			return Sensor(val), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown sensor %q", name)
+}
+
 func SwapBitOrder(b byte) byte {
 	b = ((b & 0xF0) >> 4) | ((b & 0x0F) << 4)
 	b = ((b & 0xCC) >> 2) | ((b & 0x33) << 2)
 	b = ((b & 0xAA) >> 1) | ((b & 0x55) << 1)
 	return b
 }
+
+var swapTable [256]byte
+
+func init() {
+	for idx := range swapTable {
+		swapTable[idx] = SwapBitOrder(byte(idx))
+	}
+}
+
+// SwapBitOrderSlice reverses the bit order of each byte in src, storing the
+// result in dst. dst must be at least as long as src and may be src itself.
+func SwapBitOrderSlice(dst, src []byte) {
+	dst = dst[:len(src)]
+	for idx, b := range src {
+		dst[idx] = swapTable[b]
+	}
+}
@@ -0,0 +1,2957 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	mrand "math/rand"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtldavis/dsp"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func TestFrequencyPlan(t *testing.T) {
+	p := NewParser(14, 0)
+	plan := p.FrequencyPlan()
+
+	if !strings.Contains(plan, "Region: EU") {
+		t.Fatalf("plan missing region:\n%s", plan)
+	}
+
+	for _, freq := range EU.Channels {
+		if !strings.Contains(plan, strconv.Itoa(freq)) {
+			t.Fatalf("plan missing channel %d:\n%s", freq, plan)
+		}
+	}
+}
+
+// message builds a Message from a decoded payload, padding it out to a full
+// packet.
+func message(payload ...byte) Message {
+	data := make([]byte, 10)
+	copy(data[2:], payload)
+	return NewMessage(dsp.Packet{Data: data})
+}
+
+// packet builds an over-the-air packet from a decoded payload: prepends the
+// sync word, appends a valid checksum and reverses the bit order.
+func packet(p *Parser, payload ...byte) dsp.Packet {
+	data := make([]byte, 8)
+	data[0], data[1] = 0xCB, 0x89
+	copy(data[2:], payload)
+	data = append(data[:2], p.AppendChecksum(data[2:8])...)
+
+	for idx := range data {
+		data[idx] = SwapBitOrder(data[idx])
+	}
+
+	return dsp.Packet{Data: data}
+}
+
+func TestSolarCharging(t *testing.T) {
+	for _, msg := range []Message{
+		message(0x20, 0, 0, 0x5A, 0x48),
+		message(0x20, 0, 0, 0x5A, 0x40),
+		message(0x80, 0, 0, 0x5A, 0x48),
+	} {
+		if charging, ok := msg.SolarCharging(); charging || ok {
+			t.Errorf("%s: got (%v, %v), want (false, false)", msg, charging, ok)
+		}
+	}
+}
+
+func TestAdaptiveDwell(t *testing.T) {
+	p := NewParser(14, 0)
+
+	p.Missed()
+	if p.CurrentDwell() != p.DwellTime {
+		t.Fatalf("dwell changed without AdaptiveDwell: %s", p.CurrentDwell())
+	}
+
+	p.AdaptiveDwell = true
+	for n := 1; n <= 3; n++ {
+		p.Missed()
+		if want := p.DwellTime + time.Duration(n)*p.DwellStep; p.CurrentDwell() != want {
+			t.Fatalf("after %d misses got %s, want %s", n, p.CurrentDwell(), want)
+		}
+	}
+
+	for n := 0; n < 16; n++ {
+		p.Missed()
+	}
+	if p.CurrentDwell() != p.MaxDwell {
+		t.Fatalf("dwell exceeded MaxDwell: %s", p.CurrentDwell())
+	}
+
+	for n := 0; n < 16; n++ {
+		p.adjustDwell(-p.DwellStep)
+	}
+	if p.CurrentDwell() != p.MinDwell {
+		t.Fatalf("dwell did not recover to MinDwell: %s", p.CurrentDwell())
+	}
+}
+
+func TestTemperature(t *testing.T) {
+	msg := message(0x80, 0, 0, 0x02, 0xD3)
+	if temp, ok := msg.Temperature(); !ok || temp != 4.5 {
+		t.Fatalf("got (%v, %v), want (4.5, true)", temp, ok)
+	}
+
+	msg = message(0x80, 0, 0, 0xFF, 0x60)
+	if temp, ok := msg.Temperature(); !ok || temp != -1.0 {
+		t.Fatalf("got (%v, %v), want (-1.0, true)", temp, ok)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	a := message(0x81, 3, 128, 0x02, 0xD3, 0x00, 0x12, 0x34)
+	b := message(0x81, 3, 128, 0x02, 0xDC, 0x05, 0x56, 0x78)
+
+	if !a.Equal(b) {
+		t.Fatalf("%02X and %02X should be equal", a.Data, b.Data)
+	}
+
+	c := message(0x81, 3, 128, 0x02, 0xE3)
+	if a.Equal(c) {
+		t.Fatalf("%02X and %02X should differ", a.Data, c.Data)
+	}
+
+	d := message(0x82, 3, 128, 0x02, 0xD3)
+	if a.Equal(d) {
+		t.Fatalf("%02X and %02X should differ by id", a.Data, d.Data)
+	}
+
+	// Data[5] carries no wind direction bits.
+	if e := message(0x81, 3, 128, 0x02, 0xD3, 0xC0); !a.Equal(e) {
+		t.Fatalf("%02X and %02X should be equal", a.Data, e.Data)
+	}
+
+	// Decoded sensors compare their values, ignoring unused reading bits.
+	// Sensors without a decode compare the raw reading.
+	for _, tc := range []struct {
+		a, b  Message
+		equal bool
+	}{
+		{message(0x91, 0, 0, 0x10, 0x00), message(0x91, 0, 0, 0x10, 0xFF), true},
+		{message(0x91, 0, 0, 0x10, 0x00), message(0x91, 0, 0, 0x11, 0x00), false},
+		{message(0xE1, 0, 0, 0x10, 0x00), message(0xE1, 0, 0, 0x10, 0x40), true},
+		{message(0xE1, 0, 0, 0x10, 0x00), message(0xE1, 0, 0, 0x11, 0x00), false},
+		{message(0x21, 0, 0, 0x5A, 0x48), message(0x21, 0, 0, 0x5A, 0x48), true},
+		{message(0x21, 0, 0, 0x5A, 0x48), message(0x21, 0, 0, 0x5B, 0x48), false},
+		{message(0x71, 0, 0, 0x12, 0x34), message(0x71, 0, 0, 0x56, 0x78), false},
+		{message(0x71, 0, 0, 0x12, 0x34), message(0x71, 1, 0, 0x12, 0x34), false},
+	} {
+		if equal := tc.a.Equal(tc.b); equal != tc.equal {
+			t.Errorf("%02X and %02X: got equal %v, want %v", tc.a.Data, tc.b.Data, equal, tc.equal)
+		}
+	}
+}
+
+func TestAuxStations(t *testing.T) {
+	msgs := []Message{
+		message(0x81, 0, 0, 0x02, 0xD3),
+		message(0xA1, 0, 0, 0x6E, 0x20),
+		message(0x82, 0, 0, 0x03, 0x20),
+		message(0xA2, 0, 0, 0x20, 0x30),
+	}
+
+	type reading struct {
+		temp, humidity float64
+	}
+	readings := map[int]reading{}
+
+	for _, msg := range msgs {
+		r := readings[msg.Station()]
+		if temp, ok := msg.Temperature(); ok {
+			r.temp = temp
+		}
+		if humidity, ok := msg.Humidity(); ok {
+			r.humidity = humidity
+		}
+		readings[msg.Station()] = r
+	}
+
+	expected := map[int]reading{
+		2: {4.5, 62.2},
+		3: {5.0, 80.0},
+	}
+	for station, r := range expected {
+		if readings[station] != r {
+			t.Errorf("station %d: got %+v, want %+v", station, readings[station], r)
+		}
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	p := NewParser(14, 0)
+
+	bad := packet(&p, 0x81, 0, 0, 0x02, 0xD3)
+	bad.Data[5] ^= 0x10
+
+	s := p.Summarize([]dsp.Packet{
+		packet(&p, 0x81, 0, 0, 0x02, 0xD3),
+		packet(&p, 0x81, 0, 0, 0x02, 0xE3),
+		packet(&p, 0x83, 0, 0, 0x02, 0xF3),
+		packet(&p, 0x91, 4, 0, 0x06, 0x00),
+		packet(&p, 0x91, 5, 0, 0x06, 0x00),
+		bad,
+	})
+
+	if s.Packets != 6 || s.Valid != 5 {
+		t.Fatalf("got %d/%d valid, want 5/6", s.Valid, s.Packets)
+	}
+	if s.Sensors[Temperature] != 3 || s.Sensors[WindGustSpeed] != 2 {
+		t.Fatalf("bad sensor counts: %v", s.Sensors)
+	}
+	if len(s.IDs) != 2 || s.IDs[0] != 1 || s.IDs[1] != 3 {
+		t.Fatalf("bad ids: %v", s.IDs)
+	}
+	if rate := s.CRCPassRate(); rate != 5.0/6.0 {
+		t.Fatalf("got pass rate %f", rate)
+	}
+	t.Log(s)
+
+	// A Rain packet with a one byte payload.
+	short := dsp.Packet{Data: swapped(append([]byte{0xCB, 0x89}, p.AppendChecksum([]byte{0xE0})...))}
+	if s := p.Summarize([]dsp.Packet{short}); s.Valid != 0 {
+		t.Fatalf("drop: got %d valid, want 0", s.Valid)
+	}
+	p.Malformed = MalformedEmit
+	if s := p.Summarize([]dsp.Packet{short}); s.Valid != 1 || s.Sensors[Rain] != 1 {
+		t.Fatalf("emit: got %+v", s)
+	}
+}
+
+func TestParseSensor(t *testing.T) {
+	for val := 0; val < 16; val++ {
+		sensor := Sensor(val)
+		for _, name := range []string{sensor.String(), strings.ToUpper(sensor.String())} {
+			parsed, err := ParseSensor(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsed != sensor {
+				t.Fatalf("%q: got %s, want %s", name, parsed, sensor)
+			}
+		}
+	}
+
+	if sensor, err := ParseSensor("wind gust speed"); err != nil || sensor != WindGustSpeed {
+		t.Fatalf("got (%s, %v), want %s", sensor, err, WindGustSpeed)
+	}
+
+	for _, name := range []string{"", "Pressure", "Unknown(0xZZ)", "Unknown(0x100)"} {
+		if _, err := ParseSensor(name); err == nil {
+			t.Fatalf("%q: expected error", name)
+		}
+	}
+}
+
+func TestChannelCooldown(t *testing.T) {
+	now := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	p := NewParser(14, 0)
+	p.SetClock(func() time.Time { return now })
+	p.DisableAfter = 3
+
+	hop := p.hop()
+	for n := 0; n < 3; n++ {
+		p.Missed()
+	}
+
+	disabled := p.DisabledChannels()
+	if len(disabled) != 1 || disabled[0] != hop.ChannelIdx {
+		t.Fatalf("got disabled %v, want [%d]", disabled, hop.ChannelIdx)
+	}
+
+	// The disabled channel keeps its slot in the pattern and is marked.
+	for n := 0; n < p.channelCount; n++ {
+		next := p.NextHop()
+		if next.Disabled != (next.ChannelIdx == hop.ChannelIdx) {
+			t.Fatalf("got %+v, disabled channel %d", next, hop.ChannelIdx)
+		}
+	}
+
+	now = now.Add(p.ChannelCooldown)
+
+	if disabled := p.DisabledChannels(); len(disabled) != 0 {
+		t.Fatalf("channel not re-enabled after cooldown: %v", disabled)
+	}
+
+	visited := false
+	for n := 0; n < p.channelCount; n++ {
+		if p.NextHop().ChannelIdx == hop.ChannelIdx {
+			visited = true
+		}
+	}
+	if !visited {
+		t.Fatalf("re-enabled channel %d never visited", hop.ChannelIdx)
+	}
+}
+
+func TestDisabledChannelTiming(t *testing.T) {
+	now := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	p := NewParser(14, 0)
+	p.SetClock(func() time.Time { return now })
+	p.DisableAfter = 1
+
+	ref := p.hop()
+	period := TransmitterPeriod(byte(p.ID))
+
+	// Disable the channel two hops after the reference.
+	p.NextHop()
+	disabledHop := p.NextHop()
+	p.Missed()
+	if disabled := p.DisabledChannels(); len(disabled) != 1 || disabled[0] != disabledHop.ChannelIdx {
+		t.Fatalf("got disabled %v, want [%d]", disabled, disabledHop.ChannelIdx)
+	}
+
+	missed := p.ChannelStats(disabledHop.ChannelIdx).Missed
+	dwell := p.CurrentDwell()
+
+	// Walk back to the reference, then across the disabled channel. Each hop
+	// must land where the transmitter will be a period later.
+	for p.hop().ChannelIdx != ref.ChannelIdx {
+		p.NextHop()
+	}
+	for n := 1; n <= p.channelCount+2; n++ {
+		hop := p.NextHop()
+		want := p.PredictChannel(now, ref.ChannelIdx, now.Add(time.Duration(n)*period+period/2))
+		if hop.ChannelIdx != want {
+			t.Fatalf("hop %d: got channel %d, want %d", n, hop.ChannelIdx, want)
+		}
+		if hop.Disabled != (hop.ChannelIdx == disabledHop.ChannelIdx) {
+			t.Fatalf("hop %d: got %+v, disabled channel %d", n, hop, disabledHop.ChannelIdx)
+		}
+		if hop.Disabled {
+			p.Missed()
+		}
+	}
+
+	if got := p.ChannelStats(disabledHop.ChannelIdx).Missed; got != missed {
+		t.Fatalf("missed on disabled channel counted: got %d, want %d", got, missed)
+	}
+	if got := p.CurrentDwell(); got != dwell {
+		t.Fatalf("missed on disabled channel adjusted dwell: got %s, want %s", got, dwell)
+	}
+}
+
+func TestTransmitterPeriod(t *testing.T) {
+	expected := []time.Duration{
+		2562500 * time.Microsecond,
+		2625000 * time.Microsecond,
+		2687500 * time.Microsecond,
+		2750000 * time.Microsecond,
+		2812500 * time.Microsecond,
+		2875000 * time.Microsecond,
+		2937500 * time.Microsecond,
+		3000000 * time.Microsecond,
+	}
+
+	for id, period := range expected {
+		if got := TransmitterPeriod(byte(id)); got != period {
+			t.Errorf("id %d: got %s, want %s", id, got, period)
+		}
+	}
+}
+
+func TestParsePreservesInput(t *testing.T) {
+	p := NewParser(14, 0)
+
+	pkt := packet(&p, 0x81, 0, 0, 0x02, 0xD3)
+	original := append([]byte(nil), pkt.Data...)
+
+	if msgs := p.Parse([]dsp.Packet{pkt}); len(msgs) != 1 {
+		t.Fatalf("got %d messages, want 1", len(msgs))
+	}
+
+	if !bytes.Equal(pkt.Data, original) {
+		t.Fatalf("Parse modified input: %02X, want %02X", pkt.Data, original)
+	}
+}
+
+func TestSyncWord(t *testing.T) {
+	if cfg := NewPacketConfig(14); cfg.Preamble != SyncWord {
+		t.Fatalf("got default preamble %q, want %q", cfg.Preamble, SyncWord)
+	}
+
+	syncWord := "1010101111001100"
+	cfg, err := NewSyncPacketConfig(14, syncWord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Preamble != syncWord {
+		t.Fatalf("got preamble %q, want %q", cfg.Preamble, syncWord)
+	}
+	for idx, b := range cfg.PreambleBytes {
+		if b != syncWord[idx]-'0' {
+			t.Fatalf("PreambleBytes %v don't match %q", cfg.PreambleBytes, syncWord)
+		}
+	}
+
+	for _, syncWord := range []string{"", "10101", "101010111100110z", "10101011110011001"} {
+		if _, err := NewSyncPacketConfig(14, syncWord); err == nil {
+			t.Fatalf("%q: expected error", syncWord)
+		}
+	}
+}
+
+func TestWindDirectionDeadBand(t *testing.T) {
+	north := message(0x81, 2, 0)
+
+	if dir, ok := north.WindDirectionDegrees(); !ok || dir != 9 {
+		t.Fatalf("got (%v, %v), want (9, true)", dir, ok)
+	}
+
+	north.Options.ZeroWindDirInvalid = true
+	if north.WindDirectionValid() {
+		t.Fatal("zero direction should be invalid")
+	}
+	if _, ok := north.WindDirectionDegrees(); ok {
+		t.Fatal("zero direction should not decode")
+	}
+
+	south := message(0x81, 2, 128)
+	south.Options.ZeroWindDirInvalid = true
+	if dir, ok := south.WindDirectionDegrees(); !ok || dir < 180 || dir > 182 {
+		t.Fatalf("got (%v, %v), want (~180, true)", dir, ok)
+	}
+}
+
+func TestRegionPacketConfig(t *testing.T) {
+	expected := NewPacketConfig(14)
+
+	for _, region := range []Region{EU, US} {
+		p, err := NewRegionParser(region, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := p.Cfg
+		if cfg.SymbolLength != expected.SymbolLength || cfg.SampleRate != expected.SampleRate ||
+			cfg.Preamble != expected.Preamble || cfg.PacketSymbols != expected.PacketSymbols {
+			t.Errorf("%s: got %+v, want %+v", region.Name, cfg, expected)
+		}
+		if p.channelCount != len(region.Channels) {
+			t.Errorf("%s: got %d channels, want %d", region.Name, p.channelCount, len(region.Channels))
+		}
+	}
+
+	region := EU
+	region.SyncWord = "0101"
+	if _, err := NewRegionParser(region, 0); err == nil {
+		t.Fatal("expected error for invalid sync word")
+	}
+}
+
+func TestParseEmpty(t *testing.T) {
+	p := NewParser(14, 0)
+
+	for _, pkts := range [][]dsp.Packet{nil, {}} {
+		if msgs := p.Parse(pkts); len(msgs) != 0 {
+			t.Fatalf("got %d messages from empty batch", len(msgs))
+		}
+	}
+	if len(p.channelFreqErr) != 0 {
+		t.Fatalf("empty batch updated frequency error: %v", p.channelFreqErr)
+	}
+
+	pkt := packet(&p, 0x81, 0, 0, 0x02, 0xD3)
+	if msgs := p.Parse([]dsp.Packet{pkt, pkt}); len(msgs) != 1 {
+		t.Fatalf("got %d messages from duplicate batch, want 1", len(msgs))
+	}
+}
+
+func TestFreqErrorGuard(t *testing.T) {
+	p := NewParser(14, 0)
+
+	// A packet at the very end of the buffer has no tail to measure.
+	pkt := packet(&p, 0x81, 0, 0, 0x02, 0xD3)
+	pkt.Idx = len(p.Discriminated)
+	if msgs := p.Parse([]dsp.Packet{pkt}); len(msgs) != 1 {
+		t.Fatalf("got %d messages, want 1", len(msgs))
+	}
+	if len(p.channelFreqErr) != 0 {
+		t.Fatalf("empty tail updated frequency error: %v", p.channelFreqErr)
+	}
+
+	// A tail that averages to NaN must not be stored either.
+	for idx := range p.Discriminated {
+		p.Discriminated[idx] = math.NaN()
+	}
+	pkt = packet(&p, 0x81, 0, 0, 0x02, 0xE3)
+	if msgs := p.Parse([]dsp.Packet{pkt}); len(msgs) != 1 {
+		t.Fatalf("got %d messages, want 1", len(msgs))
+	}
+	if len(p.channelFreqErr) != 0 || p.currentFreqErr != 0 {
+		t.Fatalf("NaN tail updated frequency error: %v", p.channelFreqErr)
+	}
+}
+
+func TestOnFreqEstimate(t *testing.T) {
+	p := NewParser(14, 0)
+	p.MaxFreqStep = 0
+
+	var (
+		calls      int
+		channelIdx int
+		tailLen    int
+		estimate   int
+	)
+	p.OnFreqEstimate = func(c int, tail []float64, e int) {
+		calls++
+		channelIdx, tailLen, estimate = c, len(tail), e
+	}
+
+	p.Parse([]dsp.Packet{packet(&p, 0x81, 0, 0, 0x02, 0xD3)})
+
+	if calls != 1 {
+		t.Fatalf("got %d calls, want 1", calls)
+	}
+	if channelIdx != p.hop().ChannelIdx {
+		t.Errorf("got channel %d, want %d", channelIdx, p.hop().ChannelIdx)
+	}
+	if tailLen != 16*p.Cfg.SymbolLength {
+		t.Errorf("got tail length %d, want %d", tailLen, 16*p.Cfg.SymbolLength)
+	}
+	if estimate != p.channelFreqErr[channelIdx] {
+		t.Errorf("got estimate %d, stored %d", estimate, p.channelFreqErr[channelIdx])
+	}
+}
+
+func TestConfig(t *testing.T) {
+	p := NewParser(14, 1)
+	cfg := p.Config()
+
+	if cfg.Region != "EU" || cfg.ID != 1 || cfg.SyncWord != SyncWord {
+		t.Fatalf("bad config: %+v", cfg)
+	}
+	if cfg.CRCName != "CCITT-16" || cfg.CRCPoly != 0x1021 || cfg.CRCInit != 0 {
+		t.Fatalf("bad crc config: %+v", cfg)
+	}
+	if cfg.DwellTime != 122500*time.Microsecond {
+		t.Fatalf("got dwell %s", cfg.DwellTime)
+	}
+	if cfg.SymbolLength != 14 || cfg.SampleRate != 268800 {
+		t.Fatalf("got symbol length %d, sample rate %d", cfg.SymbolLength, cfg.SampleRate)
+	}
+	if fmt.Sprint(cfg.Channels) != fmt.Sprint(EU.Channels) || fmt.Sprint(cfg.HopPattern) != fmt.Sprint(EU.HopPattern) {
+		t.Fatalf("bad channels: %v %v", cfg.Channels, cfg.HopPattern)
+	}
+
+	// The snapshot must not alias the parser's state.
+	cfg.Channels[0] = 0
+	if p.channels[0] == 0 {
+		t.Fatal("Config aliases parser channels")
+	}
+
+	if _, err := json.Marshal(cfg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUVSolarRange(t *testing.T) {
+	for _, tc := range []struct {
+		msg    Message
+		decode func(Message) (float64, bool)
+		value  float64
+	}{
+		// Reading of 250 counts, bit 5 of Data[4] doesn't scale it.
+		{message(0x41, 0, 0, 0x3E, 0x80), Message.UVIndex, 5},
+		{message(0x41, 0, 0, 0x3E, 0xA0), Message.UVIndex, 5},
+		// Reading of 500 counts.
+		{message(0x61, 0, 0, 0x7D, 0x00), Message.SolarRadiation, 500 * 1.757936},
+		{message(0x61, 0, 0, 0x7D, 0x20), Message.SolarRadiation, 500 * 1.757936},
+	} {
+		value, ok := tc.decode(tc.msg)
+		if !ok || math.Abs(value-tc.value) > 1e-9 {
+			t.Errorf("%02X: got (%v, %v), want (%v, true)", tc.msg.Data, value, ok, tc.value)
+		}
+	}
+
+	if _, ok := message(0x41, 0, 0, 0xFF, 0xC0).UVIndex(); ok {
+		t.Error("disconnected UV sensor should not decode")
+	}
+}
+
+func TestParseWithGolden(t *testing.T) {
+	p := NewParser(14, 1)
+	p.hopIdx = 0
+
+	// Zero symbols discriminate to this value when there's no frequency
+	// error.
+	zero := -2 * math.Pi * 9600 / float64(p.Cfg.SampleRate)
+
+	var buf bytes.Buffer
+	for batch, offset := range []float64{0, 0.01, -0.005, 0.02} {
+		discriminated := make([]float64, len(p.Discriminated))
+		for idx := range discriminated {
+			discriminated[idx] = zero + offset
+		}
+
+		pkt := packet(&p, 0x81, byte(batch), 0x40, 0x02, 0xD3+byte(batch)<<4)
+		pkt.Idx = 100 * batch
+
+		for _, msg := range p.ParseWith([]dsp.Packet{pkt}, discriminated) {
+			fmt.Fprintf(&buf, "%s %02X\n", msg, msg.Data)
+		}
+		fmt.Fprintln(&buf, p.NextHop())
+	}
+	buf.WriteString(p.FrequencyPlan())
+
+	golden := "testdata/parse.golden"
+	if *update {
+		if err := ioutil.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Fatalf("output doesn't match %s:\n%s", golden, buf.String())
+	}
+}
+
+func TestMaxFreqStep(t *testing.T) {
+	p := NewParser(14, 0)
+	channelIdx := p.hop().ChannelIdx
+
+	// Offset the tail by roughly 5kHz.
+	discriminated := make([]float64, len(p.Discriminated))
+	for idx := range discriminated {
+		discriminated[idx] = -2 * math.Pi * (9600 + 5000) / float64(p.Cfg.SampleRate)
+	}
+
+	p.ParseWith([]dsp.Packet{packet(&p, 0x81, 0, 0, 0x02, 0xD3)}, discriminated)
+	if freqErr := p.channelFreqErr[channelIdx]; freqErr != p.MaxFreqStep {
+		t.Fatalf("got step %d, want %d", freqErr, p.MaxFreqStep)
+	}
+
+	p.ParseWith([]dsp.Packet{packet(&p, 0x81, 0, 0, 0x02, 0xE3)}, discriminated)
+	if freqErr := p.channelFreqErr[channelIdx]; freqErr != 2*p.MaxFreqStep {
+		t.Fatalf("got %d after second step, want %d", freqErr, 2*p.MaxFreqStep)
+	}
+
+	limited := p.channelFreqErr[channelIdx]
+	p.MaxFreqStep = 0
+	p.ParseWith([]dsp.Packet{packet(&p, 0x81, 0, 0, 0x02, 0xF3)}, discriminated)
+	if step := p.channelFreqErr[channelIdx] - limited; step < 4990 || step > 5010 {
+		t.Fatalf("got step %d with unlimited step, want ~5000", step)
+	}
+}
+
+func TestForecast(t *testing.T) {
+	for val := 0; val < 16; val++ {
+		if _, ok := message(byte(val<<4), 0, 0, 0x12, 0x34, 0x56).Forecast(); ok {
+			t.Fatalf("sensor %s decoded as forecast", Sensor(val))
+		}
+	}
+}
+
+func TestCoverageReport(t *testing.T) {
+	region := Region{
+		Name:         "Test",
+		Channels:     []int{868300000, 868100000, 868200000},
+		HopPattern:   []int{0, 1, 2},
+		SymbolLength: 14,
+		SyncWord:     SyncWord,
+	}
+	p, err := NewRegionParser(region, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.channelStats[0] = ChannelStats{Received: 9, Missed: 1}
+	p.channelStats[1] = ChannelStats{Received: 0, Missed: 10}
+	p.channelStats[2] = ChannelStats{Received: 5, Missed: 5}
+
+	report := p.CoverageReport()
+	if len(report) != 3 {
+		t.Fatalf("got %d channels, want 3", len(report))
+	}
+
+	expected := []struct {
+		idx  int
+		rate float64
+	}{{1, 0}, {2, 0.5}, {0, 0.9}}
+	for idx, e := range expected {
+		if report[idx].ChannelIdx != e.idx || report[idx].SuccessRate() != e.rate {
+			t.Errorf("report[%d]: got %+v, want channel %d rate %v", idx, report[idx], e.idx, e.rate)
+		}
+	}
+}
+
+func TestStreamIdle(t *testing.T) {
+	p := NewParser(14, 0)
+
+	idle := make(chan bool, 1)
+	p.IdleTimeout = time.Millisecond
+	p.OnIdle = func() {
+		select {
+		case idle <- true:
+		default:
+		}
+	}
+
+	in := make(chan []byte)
+	out := make(chan Message)
+	go p.Stream(in, out)
+
+	select {
+	case <-idle:
+	case <-time.After(time.Second):
+		t.Fatal("idle heartbeat never fired")
+	}
+
+	in <- make([]byte, p.Cfg.BlockSize2)
+	close(in)
+
+	if _, ok := <-out; ok {
+		t.Fatal("expected no messages from an empty block")
+	}
+}
+
+func TestRainRateUnits(t *testing.T) {
+	for _, bucket := range []RainBucket{Bucket001in, Bucket02mm} {
+		// Light rain, 350 seconds between clicks.
+		light := message(0x51, 0, 0, 0x64, 0x50)
+		// Heavy rain, 350/16 seconds between clicks.
+		heavy := message(0x51, 0, 0, 0x64, 0x10)
+
+		for _, tc := range []struct {
+			msg    Message
+			clicks float64
+		}{{light, 3600.0 / 350}, {heavy, 3600.0 * 16 / 350}} {
+			tc.msg.Options.RainBucket = bucket
+
+			mm, mmOk := tc.msg.RainRateMM()
+			in, inOk := tc.msg.RainRateIn()
+			if !mmOk || !inOk {
+				t.Fatalf("%s: rain rate didn't decode", bucket)
+			}
+			if math.Abs(mm-tc.clicks*bucket.MM()) > 1e-9 {
+				t.Errorf("%s: got %f mm/hr, want %f", bucket, mm, tc.clicks*bucket.MM())
+			}
+			if math.Abs(in-mm/25.4) > 1e-9 {
+				t.Errorf("%s: %f in/hr disagrees with %f mm/hr", bucket, in, mm)
+			}
+		}
+	}
+
+	if rate, ok := message(0x51, 0, 0, 0xFF, 0x70).RainRateMM(); !ok || rate != 0 {
+		t.Fatalf("no rain: got (%v, %v), want (0, true)", rate, ok)
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	start := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+	tl := NewTimeline(start, 1000)
+
+	var times []time.Time
+	for _, batch := range []struct {
+		size int
+		idxs []int
+	}{
+		{500, []int{10, 250, 499}},
+		{500, []int{0, 10, 250}},
+	} {
+		for _, idx := range batch.idxs {
+			times = append(times, tl.Time(idx))
+		}
+		tl.Advance(batch.size)
+	}
+
+	expected := []time.Duration{10, 250, 499, 500, 510, 750}
+	for idx, tm := range times {
+		if want := start.Add(expected[idx] * time.Millisecond); !tm.Equal(want) {
+			t.Errorf("time %d: got %s, want %s", idx, tm, want)
+		}
+		if idx > 0 && !tm.After(times[idx-1]) {
+			t.Errorf("time %d not after time %d", idx, idx-1)
+		}
+	}
+
+	// Past 24 hours at the default sample rate, beyond where
+	// sample * time.Second overflows.
+	const rate = 268800
+	tl = NewTimeline(start, rate)
+	tl.Advance(25 * 3600 * rate)
+	if tm, want := tl.Time(rate/2), start.Add(25*time.Hour+500*time.Millisecond); !tm.Equal(want) {
+		t.Errorf("after 25h: got %s, want %s", tm, want)
+	}
+}
+
+func TestStationModelWind(t *testing.T) {
+	pro2 := message(0x81, 2, 0x80)
+	vue := message(0x81, 2, 0x80)
+	vue.Options.Model = Vue
+
+	if dir, _ := pro2.WindDirectionDegrees(); math.Abs(dir-(9+128*342.0/255)) > 1e-9 {
+		t.Errorf("Pro2: got %f", dir)
+	}
+	if dir, _ := vue.WindDirectionDegrees(); dir != 180 {
+		t.Errorf("Vue: got %f, want 180", dir)
+	}
+
+	pro2.Data[2], pro2.WindDirection = 0, 0
+	vue.Data[2], vue.WindDirection = 0, 0
+	if dir, _ := pro2.WindDirectionDegrees(); dir != 9 {
+		t.Errorf("Pro2: got %f, want 9", dir)
+	}
+	if dir, _ := vue.WindDirectionDegrees(); dir != 0 {
+		t.Errorf("Vue: got %f, want 0", dir)
+	}
+}
+
+func TestLinkQuality(t *testing.T) {
+	p := NewParser(14, 1)
+	p.LinkWindow = 8
+
+	if q := p.LinkQuality(1); q != 0 {
+		t.Fatalf("got %f before any packets", q)
+	}
+
+	// Receive 3 of 4 expected packets.
+	for n := 0; n < 3; n++ {
+		p.Parse([]dsp.Packet{packet(&p, 0x81, byte(n), 0, 0x02, 0xD3)})
+	}
+	p.Missed()
+
+	if q := p.LinkQuality(1); q != 0.75 {
+		t.Fatalf("got %f, want 0.75", q)
+	}
+
+	// Older outcomes fall out of the window.
+	for n := 0; n < 8; n++ {
+		p.Missed()
+	}
+	if q := p.LinkQuality(1); q != 0 {
+		t.Fatalf("got %f, want 0", q)
+	}
+}
+
+func TestFreqErrScale(t *testing.T) {
+	p := NewParser(14, 0)
+	p.FreqErrBaseOffset = 0
+
+	discriminated := make([]float64, len(p.Discriminated))
+	for idx := range discriminated {
+		discriminated[idx] = 0.01
+	}
+	copy(p.Discriminated, discriminated)
+
+	pkt := dsp.Packet{Idx: 0}
+	base, ok := p.estimateFreqError(pkt)
+	if !ok {
+		t.Fatal("no estimate")
+	}
+
+	p.FreqErrScale *= 2
+	scaled, _ := p.estimateFreqError(pkt)
+	if scaled < 2*base-1 || scaled > 2*base+1 {
+		t.Fatalf("doubling scale changed estimate from %d to %d", base, scaled)
+	}
+
+	p.FreqErrBaseOffset = 100
+	offset, _ := p.estimateFreqError(pkt)
+	if offset != scaled-100 {
+		t.Fatalf("offset estimate %d, want %d", offset, scaled-100)
+	}
+}
+
+func TestSoilTemperature(t *testing.T) {
+	// Reading of 288 counts, 32F, on port 2.
+	msg := message(0xF1, 0x12, 0, 0x48, 0x00)
+
+	if port, ok := msg.SoilLeafPort(); !ok || port != 2 {
+		t.Fatalf("got port (%v, %v), want (2, true)", port, ok)
+	}
+	if f, ok := msg.SoilTemperatureF(); !ok || f != 32 {
+		t.Fatalf("got (%v, %v), want (32, true)", f, ok)
+	}
+	if c, ok := msg.SoilTemperatureC(); !ok || c != 0 {
+		t.Fatalf("got (%v, %v), want (0, true)", c, ok)
+	}
+
+	// Reading of 540 counts, 95F.
+	msg = message(0xF1, 0x11, 0, 0x87, 0x00)
+	if c, ok := msg.SoilTemperatureC(); !ok || c != 35 {
+		t.Fatalf("got (%v, %v), want (35, true)", c, ok)
+	}
+
+	disconnected := message(0xF1, 0x11, 0, 0xFF, 0xC0)
+	if _, ok := disconnected.SoilTemperatureF(); ok {
+		t.Fatal("disconnected probe should not decode")
+	}
+	if _, ok := message(0x81, 0x11, 0, 0x48, 0x00).SoilTemperatureF(); ok {
+		t.Fatal("air temperature packet decoded as soil temperature")
+	}
+}
+
+func TestHopTo(t *testing.T) {
+	p := NewParser(14, 0)
+
+	for patternIdx, channelIdx := range EU.HopPattern {
+		hop, err := p.HopTo(patternIdx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hop.ChannelIdx != channelIdx || hop.ChannelFreq != EU.Channels[channelIdx] {
+			t.Fatalf("HopTo(%d): got %s, want channel %d", patternIdx, hop, channelIdx)
+		}
+		if next := p.NextHop(); next.ChannelIdx != EU.HopPattern[(patternIdx+1)%len(EU.HopPattern)] {
+			t.Fatalf("NextHop after HopTo(%d): got %s", patternIdx, next)
+		}
+	}
+
+	for _, patternIdx := range []int{-1, len(EU.HopPattern)} {
+		if _, err := p.HopTo(patternIdx); err == nil {
+			t.Fatalf("HopTo(%d): expected error", patternIdx)
+		}
+	}
+}
+
+func TestSuspectSensor(t *testing.T) {
+	p := NewParser(14, 1)
+
+	pkts := []dsp.Packet{
+		packet(&p, 0x81, 0, 0, 0x02, 0xD3),
+		packet(&p, 0x31, 0, 0, 0x02, 0xD3),
+	}
+
+	for _, msg := range p.Parse(pkts) {
+		if msg.Suspect {
+			t.Fatalf("%s marked suspect without a rotation", msg)
+		}
+	}
+
+	p.Rotations = map[byte][]Sensor{1: ISSRotation}
+	msgs := p.Parse(pkts)
+	if len(msgs) != 2 {
+		t.Fatalf("got %d messages, want 2", len(msgs))
+	}
+	if msgs[0].Suspect {
+		t.Errorf("%s should not be suspect", msgs[0])
+	}
+	if !msgs[1].Suspect {
+		t.Errorf("%s should be suspect", msgs[1])
+	}
+}
+
+func TestUSPlan(t *testing.T) {
+	channels := GenerateUSChannels()
+	if len(channels) != 51 {
+		t.Fatalf("got %d channels, want 51", len(channels))
+	}
+
+	unique := make(map[int]bool)
+	for idx, freq := range channels {
+		if unique[freq] {
+			t.Fatalf("duplicate frequency %d", freq)
+		}
+		unique[freq] = true
+
+		if idx > 0 && freq <= channels[idx-1] {
+			t.Fatalf("channel %d (%d) not above channel %d", idx, freq, idx-1)
+		}
+	}
+	if channels[0] != 902419338 || channels[50] != 927506863 {
+		t.Fatalf("got band edges %d, %d", channels[0], channels[50])
+	}
+
+	pattern := USHopPattern()
+	visited := make([]bool, len(channels))
+	for _, channelIdx := range pattern {
+		if channelIdx < 0 || channelIdx >= len(channels) || visited[channelIdx] {
+			t.Fatalf("hop pattern is not a permutation: %v", pattern)
+		}
+		visited[channelIdx] = true
+	}
+	if len(pattern) != len(channels) {
+		t.Fatalf("hop pattern has %d entries, want %d", len(pattern), len(channels))
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	p := NewParser(14, 0)
+	p.HopTo(0)
+
+	p.Pause()
+	for n := 0; n < 3; n++ {
+		if hop := p.NextHop(); hop.ChannelIdx != EU.HopPattern[0] {
+			t.Fatalf("NextHop advanced while paused: %s", hop)
+		}
+	}
+	if hop := p.RandHop(); hop.ChannelIdx != EU.HopPattern[0] {
+		t.Fatalf("RandHop moved while paused: %s", hop)
+	}
+
+	p.Resume()
+	if hop := p.NextHop(); hop.ChannelIdx != EU.HopPattern[1] {
+		t.Fatalf("got %s after Resume, want channel %d", hop, EU.HopPattern[1])
+	}
+}
+
+func TestRainBucketDepth(t *testing.T) {
+	const clicks = 25
+
+	for _, tc := range []struct {
+		bucket RainBucket
+		mm     float64
+	}{
+		{Bucket01mm, 2.5},
+		{Bucket02mm, 5},
+		{Bucket001in, 6.35},
+	} {
+		if mm := tc.bucket.DepthMM(clicks); math.Abs(mm-tc.mm) > 1e-9 {
+			t.Errorf("%s: got %f mm, want %f", tc.bucket, mm, tc.mm)
+		}
+		if in := tc.bucket.DepthIn(clicks); math.Abs(in-tc.mm/25.4) > 1e-9 {
+			t.Errorf("%s: got %f in, want %f", tc.bucket, in, tc.mm/25.4)
+		}
+	}
+
+	if Bucket01mm.DepthMM(clicks)*2 != Bucket02mm.DepthMM(clicks) {
+		t.Error("0.1mm bucket should be half the depth of a 0.2mm bucket")
+	}
+	if in := Bucket001in.DepthIn(clicks); math.Abs(in-0.25) > 1e-9 {
+		t.Errorf("0.01in bucket: got %f in, want 0.25", in)
+	}
+}
+
+func TestIsConverged(t *testing.T) {
+	p := NewParser(14, 0)
+
+	if p.IsConverged(100) {
+		t.Fatal("converged before any measurements")
+	}
+
+	for _, freqErr := range []int{-3000, -1500, -1200, -1180, -1170, -1175} {
+		p.setFreqErr(0, freqErr)
+		p.setFreqErr(4, freqErr+500)
+	}
+	if !p.IsConverged(100) {
+		t.Fatalf("not converged after stabilizing: %v", p.freqErrDeltas)
+	}
+	if p.IsConverged(10) {
+		t.Fatal("converged below the size of the last changes")
+	}
+
+	p.setFreqErr(4, 0)
+	if p.IsConverged(100) {
+		t.Fatal("still converged after a large change")
+	}
+}
+
+func TestAcceptSensors(t *testing.T) {
+	p := NewParser(14, 1)
+
+	pkts := []dsp.Packet{
+		packet(&p, 0x81, 2, 0, 0x02, 0xD3),
+		packet(&p, 0x91, 2, 0, 0x06, 0x00),
+		packet(&p, 0xA1, 2, 0, 0x6E, 0x20),
+		packet(&p, 0x91, 3, 0, 0x07, 0x00),
+		packet(&p, 0xE1, 3, 0, 0x10, 0x00),
+	}
+
+	if msgs := p.Parse(pkts); len(msgs) != len(pkts) {
+		t.Fatalf("got %d messages without filter, want %d", len(msgs), len(pkts))
+	}
+
+	p.AcceptSensors = map[Sensor]bool{WindGustSpeed: true}
+	msgs := p.Parse(pkts)
+	if len(msgs) != 2 {
+		t.Fatalf("got %d messages, want 2", len(msgs))
+	}
+	for _, msg := range msgs {
+		if msg.Sensor != WindGustSpeed {
+			t.Fatalf("filter let through %s", msg)
+		}
+	}
+}
+
+func TestRotationSlot(t *testing.T) {
+	p := NewParser(14, 1)
+
+	msg := p.Parse([]dsp.Packet{packet(&p, 0x81, 0, 0, 0x02, 0xD3)})[0]
+	if slot := msg.RotationSlot(); slot != -1 {
+		t.Fatalf("got slot %d without a rotation, want -1", slot)
+	}
+
+	p.Rotations = map[byte][]Sensor{1: ISSRotation}
+	for round := 0; round < 2; round++ {
+		for slot, sensor := range ISSRotation {
+			pkt := packet(&p, byte(sensor)<<4|1, byte(slot), 0, 0x10, 0x00)
+			msg := p.Parse([]dsp.Packet{pkt})[0]
+			if msg.RotationSlot() != slot {
+				t.Fatalf("round %d: %s got slot %d, want %d", round, msg, msg.RotationSlot(), slot)
+			}
+		}
+	}
+}
+
+func TestStationModelHumidity(t *testing.T) {
+	// 62.5% on either model.
+	pro2 := message(0xA1, 0, 0, 0x71, 0x20)
+	vue := message(0xA1, 0, 0, 0x71, 0x20)
+	vue.Options.Model = Vue
+
+	if rh, ok := pro2.Humidity(); !ok || rh != 62.5 {
+		t.Errorf("Pro2: got (%v, %v), want (62.5, true)", rh, ok)
+	}
+	if rh, ok := vue.Humidity(); !ok || rh != 62.5 {
+		t.Errorf("Vue: got (%v, %v), want (62.5, true)", rh, ok)
+	}
+}
+
+// fakeTuner produces noise whose amplitude depends on the tuned frequency.
+type fakeTuner struct {
+	amplitude map[int]float64
+	freq      int
+	rand      *mrand.Rand
+}
+
+func (f *fakeTuner) SetCenterFreq(freq int) error {
+	f.freq = freq
+	return nil
+}
+
+func (f *fakeTuner) Read(buf []byte) (int, error) {
+	for idx := range buf {
+		buf[idx] = byte(127.4 + f.amplitude[f.freq]*(f.rand.Float64()*2-1))
+	}
+	return len(buf), nil
+}
+
+func TestScanChannels(t *testing.T) {
+	p := NewParser(14, 0)
+	hop := p.hop()
+
+	tuner := &fakeTuner{
+		amplitude: map[int]float64{
+			EU.Channels[3]: 100,
+			EU.Channels[7]: 50,
+			EU.Channels[1]: 20,
+		},
+		rand: mrand.New(mrand.NewSource(1)),
+	}
+
+	energies, err := p.ScanChannels(context.Background(), tuner, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(energies) != len(EU.Channels) {
+		t.Fatalf("got %d channels, want %d", len(energies), len(EU.Channels))
+	}
+	for idx, channelIdx := range []int{3, 7, 1} {
+		if energies[idx].ChannelIdx != channelIdx {
+			t.Fatalf("got order %+v, want 3, 7, 1 first", energies)
+		}
+	}
+	if p.hop() != hop {
+		t.Fatal("scan changed the hop sequence")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.ScanChannels(ctx, tuner, 10*time.Millisecond); err == nil {
+		t.Fatal("expected error from cancelled context")
+	}
+}
+
+func TestIDExtraction(t *testing.T) {
+	p := NewParser(14, 0)
+
+	pkt := packet(&p, 0x83, 0, 0, 0x02, 0xD3, 0x50)
+	if msg := p.Parse([]dsp.Packet{pkt})[0]; msg.ID != 3 {
+		t.Fatalf("got default id %d, want 3", msg.ID)
+	}
+
+	// Take the id from the high nibble of Data[5].
+	p.IDByte, p.IDShift, p.IDMask = 5, 4, 0x7
+	if msg := p.Parse([]dsp.Packet{pkt})[0]; msg.ID != 5 {
+		t.Fatalf("got custom id %d, want 5", msg.ID)
+	}
+	if s := p.Summarize([]dsp.Packet{pkt}); len(s.IDs) != 1 || s.IDs[0] != 5 {
+		t.Fatalf("Summarize got ids %v, want [5]", s.IDs)
+	}
+}
+
+func TestAggregator(t *testing.T) {
+	agg := NewAggregator()
+	start := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	msgs := []Message{
+		message(0x81, 5, 0x80, 0x02, 0xD3),
+		message(0xA1, 6, 0x80, 0x71, 0x20),
+		message(0x41, 7, 0x80, 0x3E, 0x80),
+		message(0x61, 8, 0x80, 0x7D, 0x00),
+		message(0x51, 9, 0x80, 0xFF, 0x70),
+		message(0x82, 1, 0x00, 0x03, 0x20),
+		message(0xE1, 10, 0x80, 0x25, 0x00),
+		// The second collector isn't aggregated.
+		message(0xE1, 11, 0x80, 0x85, 0x00),
+	}
+	for idx := range msgs {
+		msgs[idx].Time = start.Add(time.Duration(idx) * time.Second)
+		agg.Add(msgs[idx])
+	}
+
+	obs := agg.Latest(1)
+	for _, tc := range []struct {
+		name    string
+		reading Reading
+		value   float64
+		idx     int
+	}{
+		{"Temperature", obs.Temperature, 4.5, 0},
+		{"Humidity", obs.Humidity, 62.5, 1},
+		{"UVIndex", obs.UVIndex, 5, 2},
+		{"SolarRadiation", obs.SolarRadiation, 500 * 1.757936, 3},
+		{"RainRate", obs.RainRate, 0, 4},
+		{"RainClicks", obs.RainClicks, 37, 6},
+		{"WindSpeed", obs.WindSpeed, 11, 7},
+	} {
+		if math.Abs(tc.reading.Value-tc.value) > 1e-9 || !tc.reading.Time.Equal(msgs[tc.idx].Time) {
+			t.Errorf("%s: got %+v, want %v at %s", tc.name, tc.reading, tc.value, msgs[tc.idx].Time)
+		}
+	}
+
+	if other := agg.Latest(2); other.Temperature.Value != 5 || !other.Humidity.Time.IsZero() {
+		t.Errorf("transmitter 2: got %+v", other)
+	}
+	if empty := agg.Latest(3); !empty.Temperature.Time.IsZero() || empty.ID != 3 {
+		t.Errorf("transmitter 3: got %+v", empty)
+	}
+}
+
+func TestAggregatorTTL(t *testing.T) {
+	now := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	agg := NewAggregator()
+	agg.TTL = 10 * time.Minute
+	agg.SetClock(func() time.Time { return now })
+
+	temp := message(0x81, 5, 0x80, 0x02, 0xD3)
+	temp.Time = now
+	agg.Add(temp)
+
+	now = now.Add(5 * time.Minute)
+	humidity := message(0xA1, 5, 0x80, 0x71, 0x20)
+	humidity.Time = now
+	agg.Add(humidity)
+
+	if obs := agg.Latest(1); obs.Temperature.Stale || obs.Humidity.Stale {
+		t.Fatalf("fresh readings marked stale: %+v", obs)
+	}
+
+	now = now.Add(6 * time.Minute)
+	obs := agg.Latest(1)
+	if !obs.Temperature.Stale {
+		t.Error("temperature should be stale")
+	}
+	if obs.Humidity.Stale || obs.WindSpeed.Stale {
+		t.Error("humidity and wind should still be fresh")
+	}
+	if obs.UVIndex.Stale {
+		t.Error("never received readings should not be stale")
+	}
+}
+
+func TestAppendChecksum(t *testing.T) {
+	p := NewParser(14, 0)
+
+	payload := []byte{0x81, 0x02, 0x40, 0x02, 0xD3, 0x00}
+	data := p.AppendChecksum(append([]byte(nil), payload...))
+
+	if len(data) != len(payload)+2 || !bytes.Equal(data[:len(payload)], payload) {
+		t.Fatalf("got %02X, want %02X followed by checksum", data, payload)
+	}
+	if !p.Valid(data) {
+		t.Fatalf("%02X failed Valid", data)
+	}
+
+	data[3] ^= 0x01
+	if p.Valid(data) {
+		t.Fatalf("corrupted %02X passed Valid", data)
+	}
+
+	// Spare capacity in the payload's backing array is left untouched.
+	buf := append(make([]byte, 0, 16), payload...)
+	p.AppendChecksum(buf)
+	if spare := buf[len(buf) : len(buf)+2]; spare[0] != 0 || spare[1] != 0 {
+		t.Fatalf("wrote %02X past the payload", spare)
+	}
+}
+
+func TestIsCalm(t *testing.T) {
+	calm := message(0x81, 0, 0)
+	north := message(0x81, 2, 0)
+
+	if !calm.IsCalm() {
+		t.Error("zero wind speed should be calm")
+	}
+	if north.IsCalm() {
+		t.Error("light north wind should not be calm")
+	}
+	if dir, ok := north.WindDirectionDegrees(); !ok || dir != 9 {
+		t.Errorf("north wind: got (%v, %v), want (9, true)", dir, ok)
+	}
+}
+
+func TestInfluxLine(t *testing.T) {
+	msg := message(0x81, 0, 0, 0x02, 0xD3)
+	msg.Time = time.Unix(1433116800, 0)
+
+	line, ok := msg.InfluxLine()
+	if expected := "davis,id=1,sensor=temperature value=4.5 1433116800000000000"; !ok || line != expected {
+		t.Fatalf("got (%q, %v), want %q", line, ok, expected)
+	}
+
+	for _, tc := range []struct {
+		msg  Message
+		line string
+	}{
+		{message(0x91, 0, 0, 0x10, 0x00), `davis,id=1,sensor=wind\ gust\ speed value=16`},
+		{message(0xE1, 0, 0, 0x10, 0x00), `davis,id=1,sensor=rain value=16`},
+		{message(0xF1, 0x11, 0, 0x48, 0x00), `davis,id=1,sensor=soil/leaf value=32`},
+	} {
+		if line, ok := tc.msg.InfluxLine(); !ok || line != tc.line {
+			t.Errorf("got (%q, %v), want %q", line, ok, tc.line)
+		}
+	}
+
+	if _, ok := message(0x41, 0, 0, 0xFF, 0xC0).InfluxLine(); ok {
+		t.Fatal("disconnected sensor should not produce a line")
+	}
+	for _, sensor := range []Sensor{SuperCapVoltage, Light} {
+		if line, ok := message(byte(sensor)<<4|1, 0, 0, 0x10, 0x00).InfluxLine(); ok {
+			t.Errorf("%s without a decode produced %q", sensor, line)
+		}
+	}
+}
+
+func TestSetClock(t *testing.T) {
+	now := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	p := NewParser(14, 0)
+	p.SetClock(func() time.Time { return now })
+
+	msgs := p.Parse([]dsp.Packet{packet(&p, 0x81, 0, 0, 0x02, 0xD3)})
+	if len(msgs) != 1 || !msgs[0].Time.Equal(now) {
+		t.Fatalf("got %+v, want time %s", msgs, now)
+	}
+
+	p.SetClock(nil)
+	msgs = p.Parse([]dsp.Packet{packet(&p, 0x81, 0, 0, 0x02, 0xD3)})
+	if msgs[0].Time.Equal(now) {
+		t.Fatal("SetClock(nil) didn't restore the real clock")
+	}
+}
+
+func TestPressure(t *testing.T) {
+	for val := 0; val < 16; val++ {
+		if _, ok := message(byte(val<<4), 0, 0, 0x75, 0x30).Pressure(); ok {
+			t.Fatalf("sensor %s decoded as pressure", Sensor(val))
+		}
+	}
+}
+
+func TestParseDistinct(t *testing.T) {
+	p := NewParser(14, 0)
+
+	var pkts []dsp.Packet
+	for n := 0; n < 1<<14; n++ {
+		pkts = append(pkts, packet(&p, 0x81, byte(n), byte(n>>8), 0x02, 0xD3))
+	}
+	pkts = append(pkts, pkts[:16]...)
+
+	if msgs := p.Parse(pkts); len(msgs) != 1<<14 {
+		t.Fatalf("got %d messages, want %d", len(msgs), 1<<14)
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	p := NewParser(14, 0)
+
+	var pkts []dsp.Packet
+	for n := 0; n < 16; n++ {
+		pkt := packet(&p, 0x81, byte(n), 0, 0x02, 0xD3)
+		pkts = append(pkts, pkt, pkt)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		p.Parse(pkts)
+	}
+}
+
+func TestSwapBitOrderSlice(t *testing.T) {
+	src := make([]byte, 256)
+	for idx := range src {
+		src[idx] = byte(idx)
+	}
+
+	dst := make([]byte, len(src))
+	SwapBitOrderSlice(dst, src)
+	for idx, b := range src {
+		if dst[idx] != SwapBitOrder(b) {
+			t.Fatalf("0x%02X: got 0x%02X, want 0x%02X", b, dst[idx], SwapBitOrder(b))
+		}
+	}
+
+	SwapBitOrderSlice(dst, dst)
+	if !bytes.Equal(dst, src) {
+		t.Fatal("swapping twice in place should restore the input")
+	}
+}
+
+func BenchmarkSwapBitOrder(b *testing.B) {
+	buf := make([]byte, 512)
+	mrand.Read(buf)
+
+	b.SetBytes(int64(len(buf)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		for idx, v := range buf {
+			buf[idx] = SwapBitOrder(v)
+		}
+	}
+}
+
+func BenchmarkSwapBitOrderSlice(b *testing.B) {
+	buf := make([]byte, 512)
+	mrand.Read(buf)
+
+	b.SetBytes(int64(len(buf)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		SwapBitOrderSlice(buf, buf)
+	}
+}
+
+func TestFreqErrorForChannel(t *testing.T) {
+	p := NewParser(14, 0)
+
+	discriminated := make([]float64, len(p.Discriminated))
+	for idx := range discriminated {
+		discriminated[idx] = -2 * math.Pi * (9600 + 500) / float64(p.Cfg.SampleRate)
+	}
+
+	visited := map[int]bool{}
+	for _, patternIdx := range []int{0, 3} {
+		hop, _ := p.HopTo(patternIdx)
+		visited[hop.ChannelIdx] = true
+		p.ParseWith([]dsp.Packet{packet(&p, 0x81, byte(patternIdx), 0, 0x02, 0xD3)}, discriminated)
+	}
+
+	for channelIdx := range EU.Channels {
+		freqErr, ok := p.FreqErrorForChannel(channelIdx)
+		if ok != visited[channelIdx] {
+			t.Fatalf("channel %d: got measured %v, want %v", channelIdx, ok, visited[channelIdx])
+		}
+		if ok && freqErr != p.channelFreqErr[channelIdx] {
+			t.Fatalf("channel %d: got %d, want %d", channelIdx, freqErr, p.channelFreqErr[channelIdx])
+		}
+		if !ok && freqErr != 0 {
+			t.Fatalf("channel %d: unmeasured channel got %d", channelIdx, freqErr)
+		}
+	}
+}
+
+func TestFreqErrorAge(t *testing.T) {
+	p := NewParser(14, 0)
+
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.SetClock(func() time.Time { return now })
+
+	if age := p.FreqErrorAge(3); age != -1 {
+		t.Fatalf("unmeasured channel: got %v, want -1", age)
+	}
+
+	p.setFreqErr(3, 1200)
+	for _, want := range []time.Duration{0, time.Minute, time.Hour} {
+		now = time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC).Add(want)
+		if age := p.FreqErrorAge(3); age != want {
+			t.Fatalf("got %v, want %v", age, want)
+		}
+	}
+
+	p.setFreqErr(3, 1250)
+	if age := p.FreqErrorAge(3); age != 0 {
+		t.Fatalf("after revisit: got %v, want 0", age)
+	}
+
+	if err := p.LoadState(p.SaveState()); err != nil {
+		t.Fatal(err)
+	}
+	if age := p.FreqErrorAge(3); age != -1 {
+		t.Fatalf("after LoadState: got %v, want -1", age)
+	}
+}
+
+func TestRainRateOverflow(t *testing.T) {
+	overflow := message(0x51, 0, 0, 0xFE, 0x70)
+	if rate, ok := overflow.RainRateMM(); !ok || rate != 0 {
+		t.Fatalf("overflow: got (%v, %v), want (0, true)", rate, ok)
+	}
+
+	// Just below the timer's maximum is still a measurable rate.
+	slow := message(0x51, 0, 0, 0xFD, 0x70)
+	if rate, ok := slow.RainRateIn(); !ok || math.Abs(rate-0.01*3600/1003) > 1e-9 {
+		t.Fatalf("slow: got (%v, %v), want (%v, true)", rate, ok, 0.01*3600/1003)
+	}
+
+	// The same bytes in heavy rain mode aren't an overflow.
+	heavy := message(0x51, 0, 0, 0xFE, 0x30)
+	if rate, _ := heavy.RainRateMM(); rate == 0 {
+		t.Fatal("heavy rain decoded as overflow")
+	}
+}
+
+func TestRainCollectors(t *testing.T) {
+	acc := NewRainAccumulator()
+
+	// Collector 0 counts 10 -> 13, collector 1 counts 126 -> 1 across the wrap.
+	for _, counter := range []byte{10, 0x80 | 126, 11, 0x80 | 127, 13, 0x80 | 1} {
+		msg := message(0xE3, 0, 0, counter)
+		if msg.Collector != counter>>7 {
+			t.Fatalf("counter %02X: got collector %d", counter, msg.Collector)
+		}
+		acc.Add(msg)
+	}
+
+	if clicks := acc.Clicks(3, 0); clicks != 3 {
+		t.Fatalf("collector 0: got %d clicks, want 3", clicks)
+	}
+	if clicks := acc.Clicks(3, 1); clicks != 3 {
+		t.Fatalf("collector 1: got %d clicks, want 3", clicks)
+	}
+	if clicks := acc.Clicks(4, 0); clicks != 0 {
+		t.Fatalf("unknown transmitter: got %d clicks, want 0", clicks)
+	}
+}
+
+func TestRainReset(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		counters []byte
+		clicks   int
+	}{
+		// 100 -> 102, then the transmitter restarts and counts 0 -> 2.
+		{"reset", []byte{100, 101, 102, 0, 1, 2}, 4},
+		// Tips before the first message after the reset are lost.
+		{"reset with rain", []byte{100, 102, 1, 3}, 4},
+		// A corrupt packet reading 5 between 100 and 101.
+		{"glitch", []byte{100, 5, 101}, 1},
+		// Small drops across the wrap are rain.
+		{"wrap", []byte{126, 127, 2}, 4},
+	} {
+		acc := NewRainAccumulator()
+		for _, counter := range tc.counters {
+			acc.Add(message(0xE3, 0, 0, counter))
+		}
+		if clicks := acc.Clicks(3, 0); clicks != tc.clicks {
+			t.Errorf("%s: got %d clicks, want %d", tc.name, clicks, tc.clicks)
+		}
+	}
+}
+
+func TestNoRainCollector(t *testing.T) {
+	none := message(0xE3, 0, 0, 0xFF, 0xFF)
+	if clicks, ok := none.RainClicks(); ok {
+		t.Fatalf("no collector: got (%d, true), want not available", clicks)
+	}
+
+	// Counter 127 on the second collector shares Data[3] with the sentinel.
+	full := message(0xE3, 0, 0, 0xFF, 0x00)
+	if clicks, ok := full.RainClicks(); !ok || clicks != 127 {
+		t.Fatalf("collector 1: got (%d, %v), want (127, true)", clicks, ok)
+	}
+
+	acc := NewRainAccumulator()
+	for _, msg := range []Message{message(0xE3, 0, 0, 0x85), none, message(0xE3, 0, 0, 0x86)} {
+		acc.Add(msg)
+	}
+	if clicks := acc.Clicks(3, 1); clicks != 1 {
+		t.Fatalf("got %d clicks, want 1", clicks)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	payload := []byte{0x80, 0x04, 0x70, 0x2D, 0x30, 0x00}
+
+	if checksum := Checksum(payload); checksum != 0xDE51 {
+		t.Fatalf("got %04X, want DE51", checksum)
+	}
+
+	p := NewParser(14, 0)
+	if checksum := p.Checksum(payload); checksum != Checksum(payload) {
+		t.Fatalf("parser got %04X, want %04X", checksum, Checksum(payload))
+	}
+}
+
+func TestStuck(t *testing.T) {
+	p := NewParser(14, 0)
+	p.StuckCount = 3
+	p.StuckDuration = time.Minute
+
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.SetClock(func() time.Time { return now })
+
+	parse := func(payload ...byte) Message {
+		now = now.Add(30 * time.Second)
+		return p.ParseWith([]dsp.Packet{packet(&p, payload...)}, p.Discriminated)[0]
+	}
+
+	for n := 1; n <= 4; n++ {
+		msg := parse(0x80, byte(n), 0, 0x2D, 0x30)
+		if want := n >= 3; msg.Stuck != want {
+			t.Fatalf("reading %d: got stuck %v, want %v", n, msg.Stuck, want)
+		}
+	}
+
+	// Other sensors don't interrupt the run, a changed value ends it.
+	if msg := parse(0xA0, 0, 0, 0x2D, 0x30); msg.Stuck {
+		t.Fatal("humidity stuck after one reading")
+	}
+	if msg := parse(0x80, 0, 0, 0x2D, 0x30); !msg.Stuck {
+		t.Fatal("temperature unstuck by humidity")
+	}
+	if msg := parse(0x80, 0, 0, 0x2D, 0x40); msg.Stuck {
+		t.Fatal("changed temperature still stuck")
+	}
+
+	// A dry rain counter, and sensors without a decode, are never stuck.
+	for _, payload := range [][]byte{
+		{0xE0, 0, 0, 0x05, 0x00},
+		{0x50, 0, 0, 0xFF, 0x00},
+		{0x20, 0, 0, 0x5A, 0x48},
+		{0x70, 0, 0, 0x12, 0x34},
+	} {
+		for n := 0; n < 5; n++ {
+			if msg := parse(payload...); msg.Stuck {
+				t.Fatalf("%s stuck after %d readings", msg.Sensor, n+1)
+			}
+		}
+	}
+}
+
+func TestWindStatsSources(t *testing.T) {
+	p := NewParser(14, 0)
+	stats := NewWindStats()
+
+	// ISS on id 0 alongside an anemometer transmitter on id 1.
+	pkts := []dsp.Packet{
+		packet(&p, 0x80, 4, 0x40, 0x2D, 0x30),
+		packet(&p, 0x21, 20, 0xC0, 0x00, 0x00),
+		packet(&p, 0xA0, 6, 0x40, 0x2D, 0x30),
+		packet(&p, 0x81, 30, 0xC0, 0x00, 0x00),
+	}
+	for _, pkt := range pkts {
+		for _, msg := range p.ParseWith([]dsp.Packet{pkt}, p.Discriminated) {
+			stats.Add(msg)
+		}
+	}
+
+	for _, test := range []struct {
+		id        byte
+		mean      float64
+		max       float64
+		direction byte
+	}{
+		{0, 5, 6, 0x40},
+		{1, 25, 30, 0xC0},
+	} {
+		s := stats.Summary(test.id)
+		want := message(test.id, 0, test.direction)
+		wantDir, _ := want.WindDirectionDegrees()
+
+		if s.Source != test.id || s.Samples != 2 || s.MeanSpeed != test.mean || s.MaxSpeed != test.max {
+			t.Fatalf("id %d: got %+v", test.id, s)
+		}
+		if s.Direction.Value != wantDir {
+			t.Fatalf("id %d: got direction %v, want %v", test.id, s.Direction.Value, wantDir)
+		}
+	}
+}
+
+func TestStartOffset(t *testing.T) {
+	p, err := NewRegionParser(US, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := p.StartOffset(2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := p.StartOffset(2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first != 0 || second != len(US.HopPattern)/2 {
+		t.Fatalf("got offsets %d and %d, want 0 and %d", first, second, len(US.HopPattern)/2)
+	}
+	if _, err := p.HopTo(second); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.StartOffset(2, 2); err == nil {
+		t.Fatal("expected error for index beyond receiver count")
+	}
+	if _, err := p.StartOffset(0, 0); err == nil {
+		t.Fatal("expected error for zero receivers")
+	}
+}
+
+func TestSolarNight(t *testing.T) {
+	// At night the sensor genuinely reads zero, in either range.
+	for _, msg := range []Message{
+		message(0x61, 0, 0, 0x00, 0x00),
+		message(0x61, 0, 0, 0x00, 0x20),
+	} {
+		if value, ok := msg.SolarRadiation(); !ok || value != 0 {
+			t.Fatalf("%02X: got (%v, %v), want (0, true)", msg.Data, value, ok)
+		}
+	}
+
+	if value, ok := message(0x61, 0, 0, 0xFF, 0xC0).SolarRadiation(); ok {
+		t.Fatalf("disconnected sensor: got (%v, %v), want not ok", value, ok)
+	}
+}
+
+func TestLogf(t *testing.T) {
+	p := NewParser(14, 0)
+
+	var lines []string
+	p.Logf = func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+
+	good := packet(&p, 0x80, 0, 0, 0x2D, 0x30)
+	bad := packet(&p, 0x80, 0, 0, 0x2D, 0x30)
+	bad.Data[5] ^= 0x01
+
+	if msgs := p.ParseWith([]dsp.Packet{good, bad}, p.Discriminated); len(msgs) != 1 {
+		t.Fatalf("got %d messages, want 1", len(msgs))
+	}
+	hop := p.NextHop()
+
+	want := []string{
+		fmt.Sprintf("checksum failed: %02X", NewMessage(dsp.Packet{Data: swapped(bad.Data)}).Data),
+		fmt.Sprintf("hop: %s", hop),
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got %q, want %q", lines, want)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	p := NewParser(14, 0)
+	p.EventBuffer = 2
+
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.SetClock(func() time.Time { return now })
+
+	// Nothing is sent before Events is called.
+	p.NextHop()
+	events := p.Events()
+
+	bad := packet(&p, 0x80, 0, 0, 0x2D, 0x30)
+	bad.Data[5] ^= 0x01
+	p.Parse([]dsp.Packet{bad})
+
+	event := <-events
+	want := Event{now, EventCRCFailure, p.hop().ChannelIdx, fmt.Sprintf("%02X", swapped(bad.Data)[2:])}
+	if event != want {
+		t.Fatalf("got %+v, want %+v", event, want)
+	}
+
+	// Once full, further events are dropped.
+	for n := 0; n < 3; n++ {
+		p.NextHop()
+	}
+	if len(events) != 2 {
+		t.Fatalf("got %d buffered events, want 2", len(events))
+	}
+	if event := <-events; event.Kind != EventHop {
+		t.Fatalf("got %s event, want %s", event.Kind, EventHop)
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	p := NewParser(14, 0)
+
+	// A truncated capture: header and reading with a valid checksum, but no
+	// flags byte.
+	data := append([]byte{0xCB, 0x89}, p.AppendChecksum([]byte{0x80, 5, 0x40, 0x2D, 0x30})...)
+	short := dsp.Packet{Data: swapped(data)}
+	if !p.Valid(swapped(short.Data)[2:]) {
+		t.Fatal("test packet fails the checksum")
+	}
+
+	if msgs := p.Parse([]dsp.Packet{short}); len(msgs) != 0 {
+		t.Fatalf("drop: got %d messages, want 0", len(msgs))
+	}
+
+	p.Malformed = MalformedEmit
+	msgs := p.Parse([]dsp.Packet{short, packet(&p, 0x81, 5, 0x40, 0x2D, 0x30)})
+	if len(msgs) != 2 {
+		t.Fatalf("emit: got %d messages, want 2", len(msgs))
+	}
+	if !msgs[0].Malformed || msgs[1].Malformed {
+		t.Fatalf("got malformed %v and %v, want true and false", msgs[0].Malformed, msgs[1].Malformed)
+	}
+	if len(msgs[0].Data) != messageLength {
+		t.Fatalf("got %d bytes of data, want %d", len(msgs[0].Data), messageLength)
+	}
+	if temp, ok := msgs[0].Temperature(); !ok || temp != 72.3 {
+		t.Fatalf("got temperature (%v, %v), want (72.3, true)", temp, ok)
+	}
+}
+
+// swapped returns a copy of data with each byte's bit order reversed.
+func swapped(data []byte) []byte {
+	out := make([]byte, len(data))
+	SwapBitOrderSlice(out, data)
+	return out
+}
+
+func TestTransmitterTiming(t *testing.T) {
+	p, err := NewRegionParser(US, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.SetClock(func() time.Time { return now })
+
+	// The ISS on id 0 and an anemometer transmitter on id 3.
+	p.Parse([]dsp.Packet{packet(&p, 0x80, 5, 0x40, 0x2D, 0x30), packet(&p, 0x23, 5, 0x40, 0x5A, 0x48)})
+
+	arrival := p.sampleTime(0)
+	for _, id := range []byte{0, 3} {
+		next, ok := p.NextExpected(id)
+		if want := arrival.Add(TransmitterPeriod(id)); !ok || !next.Equal(want) {
+			t.Fatalf("id %d: got (%v, %v), want (%v, true)", id, next, ok, want)
+		}
+	}
+	if _, ok := p.NextExpected(5); ok {
+		t.Fatal("id 5 expected without a packet")
+	}
+
+	// Ten of id 0's periods only span nine of id 3's.
+	ref, refChannelIdx := now, US.HopPattern[0]
+	later := now.Add(10 * TransmitterPeriod(0))
+	if channelIdx := p.PredictChannelFor(0, ref, refChannelIdx, later); channelIdx != US.HopPattern[10] {
+		t.Fatalf("id 0: got channel %d, want %d", channelIdx, US.HopPattern[10])
+	}
+	if channelIdx := p.PredictChannelFor(3, ref, refChannelIdx, later); channelIdx != US.HopPattern[9] {
+		t.Fatalf("id 3: got channel %d, want %d", channelIdx, US.HopPattern[9])
+	}
+	if p.PredictChannel(ref, refChannelIdx, later) != p.PredictChannelFor(0, ref, refChannelIdx, later) {
+		t.Fatal("PredictChannel doesn't use the parser's id")
+	}
+}
+
+func TestPredictChannel(t *testing.T) {
+	p, err := NewRegionParser(US, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	period := TransmitterPeriod(2)
+	ref := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	refChannelIdx := US.HopPattern[10]
+
+	for _, tc := range []struct {
+		elapsed time.Duration
+		idx     int
+	}{
+		{0, 10},
+		{period / 2, 10},
+		{3*period + period/2, 13},
+		{time.Duration(len(US.HopPattern)+1) * period, 11},
+		{-period, 9},
+		{-period / 2, 9},
+	} {
+		got := p.PredictChannel(ref, refChannelIdx, ref.Add(tc.elapsed))
+		if want := US.HopPattern[tc.idx]; got != want {
+			t.Errorf("elapsed %s: got channel %d, want %d", tc.elapsed, got, want)
+		}
+	}
+
+	if got := p.PredictChannel(ref, len(US.Channels), ref); got != -1 {
+		t.Errorf("unknown channel: got %d, want -1", got)
+	}
+}
+
+func TestNoWindSensor(t *testing.T) {
+	msg := message(0x80, 0xFF, 0xFF, 0x2D, 0x30)
+	msg.Time = time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if msg.HasWindSensor() || msg.WindDirectionValid() || msg.IsCalm() {
+		t.Fatal("no wind sensor reported as having wind")
+	}
+	if _, ok := msg.WindSpeedMPH(); ok {
+		t.Fatal("no wind sensor decoded a speed")
+	}
+	if _, ok := msg.WindDirectionDegrees(); ok {
+		t.Fatal("no wind sensor decoded a direction")
+	}
+
+	agg := NewAggregator()
+	agg.Add(msg)
+	if obs := agg.Latest(0); !obs.WindSpeed.Time.IsZero() || !obs.WindDirection.Time.IsZero() {
+		t.Fatalf("aggregated wind from no wind sensor: %+v", obs)
+	}
+
+	// Either byte alone at full scale is real wind.
+	if speed, ok := message(0x80, 0xFF, 0x40).WindSpeedMPH(); !ok || speed != 255 {
+		t.Fatalf("got (%v, %v), want (255, true)", speed, ok)
+	}
+	if !message(0x80, 4, 0xFF).WindDirectionValid() {
+		t.Fatal("wind direction 0xFF should be valid")
+	}
+}
+
+func TestLastReadings(t *testing.T) {
+	agg := NewAggregator()
+
+	msgs := []Message{
+		message(0x80, 0, 0, 0x2D, 0x30),
+		message(0xA0, 0, 0, 0x2D, 0x30),
+		message(0x80, 0, 0, 0x2E, 0x30),
+		message(0x50, 0, 0, 0xFF, 0x00),
+		message(0x81, 0, 0, 0x10, 0x00),
+	}
+	for _, msg := range msgs {
+		agg.Add(msg)
+	}
+
+	readings := agg.LastReadings(0)
+	if len(readings) != 3 {
+		t.Fatalf("got %d sensors, want 3", len(readings))
+	}
+	for _, want := range msgs[1:4] {
+		if got := readings[want.Sensor]; !bytes.Equal(got.Data, want.Data) {
+			t.Errorf("%s: got %02X, want %02X", want.Sensor, got.Data, want.Data)
+		}
+	}
+
+	if readings := agg.LastReadings(2); len(readings) != 0 {
+		t.Fatalf("unknown transmitter: got %d sensors, want 0", len(readings))
+	}
+}
+
+func TestStrictHopPattern(t *testing.T) {
+	region := EU
+	region.HopPattern = []int{0, 4, 8, 1, 5, 3, 6, 2, 4}
+
+	if _, err := NewRegionParser(region, 0); err != nil {
+		t.Fatalf("loose: %s", err)
+	}
+
+	region.StrictHopPattern = true
+	if _, err := NewRegionParser(region, 0); err == nil {
+		t.Fatal("strict: expected error for repeated channel")
+	}
+
+	region.HopPattern = EU.HopPattern
+	if _, err := NewRegionParser(region, 0); err != nil {
+		t.Fatalf("strict: %s", err)
+	}
+}
+
+func TestTransmitMode(t *testing.T) {
+	for val := 0; val < 16; val++ {
+		if _, ok := message(byte(val<<4), 0, 0, 0x12, 0x34, 0xFF).TransmitMode(); ok {
+			t.Fatalf("sensor %s decoded a transmit mode", Sensor(val))
+		}
+	}
+}
+
+func TestFirmwareHint(t *testing.T) {
+	// Supercap voltage with the panel charging.
+	if _, ok := message(0x20, 0, 0, 0x5A, 0x48, 0x00).FirmwareHint(); ok {
+		t.Fatal("supercap packet decoded a firmware version")
+	}
+	for val := 0; val < 16; val++ {
+		if _, ok := message(byte(val<<4), 0, 0, 0x12, 0x34, 0xFF).FirmwareHint(); ok {
+			t.Fatalf("sensor %s decoded a firmware version", Sensor(val))
+		}
+	}
+}
+
+func TestRecentStats(t *testing.T) {
+	p := NewParser(14, 0)
+	p.StatsRetention = 10 * time.Minute
+
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.SetClock(func() time.Time { return now })
+
+	bad := packet(&p, 0x80, 0, 0, 0x2D, 0x30)
+	bad.Data[5] ^= 0x01
+	p.ParseWith([]dsp.Packet{packet(&p, 0x80, 0, 0, 0x2D, 0x30), bad}, p.Discriminated)
+	p.Missed()
+
+	now = now.Add(4 * time.Minute)
+	p.ParseWith([]dsp.Packet{packet(&p, 0xA0, 0, 0, 0x2D, 0x30)}, p.Discriminated)
+
+	if stats := p.RecentStats(5 * time.Minute); stats != (ParseStats{Valid: 2, CRCFailures: 1, Missed: 1}) {
+		t.Fatalf("got %+v", stats)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if stats := p.RecentStats(5 * time.Minute); stats != (ParseStats{Valid: 1}) {
+		t.Fatalf("after aging: got %+v", stats)
+	}
+
+	// Events past retention are discarded even for longer windows.
+	now = now.Add(5 * time.Minute)
+	p.Missed()
+	if stats := p.RecentStats(time.Hour); stats != (ParseStats{Valid: 1, Missed: 1}) {
+		t.Fatalf("after retention: got %+v", stats)
+	}
+	if len(p.recentEvents) != 2 {
+		t.Fatalf("retained %d events, want 2", len(p.recentEvents))
+	}
+}
+
+func TestIsLocked(t *testing.T) {
+	p := NewParser(14, 0)
+	good := packet(&p, 0x80, 0, 0, 0x2D, 0x30)
+
+	// Packets from other transmitters don't count towards lock.
+	for n := 0; n < p.LockAfter; n++ {
+		p.Parse([]dsp.Packet{packet(&p, 0x83, 0, 0, 0x2D, 0x30)})
+	}
+	if p.IsLocked() {
+		t.Fatal("locked on another transmitter")
+	}
+
+	// A miss restarts the count.
+	for _, received := range []bool{true, true, false, true, true} {
+		if received {
+			p.Parse([]dsp.Packet{good})
+		} else {
+			p.Missed()
+		}
+		if p.IsLocked() {
+			t.Fatal("locked early")
+		}
+	}
+	p.Parse([]dsp.Packet{good})
+	if !p.IsLocked() {
+		t.Fatal("not locked after consecutive receptions")
+	}
+
+	for n := 1; n <= p.UnlockAfter; n++ {
+		p.Missed()
+		if locked := p.IsLocked(); locked != (n < p.UnlockAfter) {
+			t.Fatalf("after %d misses: got locked %v", n, locked)
+		}
+	}
+}
+
+func TestObservedRotation(t *testing.T) {
+	p := NewParser(14, 0)
+
+	// Two rotations of the ISS, starting part way through.
+	var want []Sensor
+	for n := 0; n < 2*len(ISSRotation); n++ {
+		sensor := ISSRotation[(n+3)%len(ISSRotation)]
+		p.Parse([]dsp.Packet{packet(&p, byte(sensor)<<4, 0, 0, byte(n), 0x30)})
+		if n < len(ISSRotation) {
+			want = append(want, sensor)
+			if rotation := p.ObservedRotation(0); rotation != nil {
+				t.Fatalf("after %d packets: got %v", n+1, rotation)
+			}
+		}
+	}
+
+	rotation := p.ObservedRotation(0)
+	if len(rotation) != len(want) {
+		t.Fatalf("got %v, want %v", rotation, want)
+	}
+	for idx := range want {
+		if rotation[idx] != want[idx] {
+			t.Fatalf("got %v, want %v", rotation, want)
+		}
+	}
+	if rotation := p.ObservedRotation(1); rotation != nil {
+		t.Fatalf("unknown id: got %v", rotation)
+	}
+}
+
+func TestHopEfficiency(t *testing.T) {
+	p := NewParser(14, 0)
+	period := TransmitterPeriod(0)
+
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.SetClock(func() time.Time { return now })
+
+	if efficiency := p.HopEfficiency(); efficiency != 0 {
+		t.Fatalf("no events: got %v, want 0", efficiency)
+	}
+
+	// Every fourth packet missed.
+	for n := 0; n < 16; n++ {
+		if n%4 == 3 {
+			p.Missed()
+		} else {
+			p.ParseWith([]dsp.Packet{packet(&p, 0x80, 0, 0, 0x2D, 0x30)}, p.Discriminated)
+		}
+		now = now.Add(period)
+	}
+	if efficiency := p.HopEfficiency(); efficiency != 0.75 {
+		t.Fatalf("missed packets: got %v, want 0.75", efficiency)
+	}
+
+	// Hopping at twice the period catches every other packet without a
+	// single checksum failure.
+	p.recentEvents = nil
+	for n := 0; n < 8; n++ {
+		p.ParseWith([]dsp.Packet{packet(&p, 0x80, 0, 0, 0x2D, 0x30)}, p.Discriminated)
+		now = now.Add(2 * period)
+	}
+	if efficiency := p.HopEfficiency(); math.Abs(efficiency-8.0/15) > 1e-9 {
+		t.Fatalf("slow hops: got %v, want %v", efficiency, 8.0/15)
+	}
+	if stats := p.RecentStats(time.Hour); stats.CRCFailures != 0 {
+		t.Fatalf("got %d checksum failures", stats.CRCFailures)
+	}
+
+	// Packets from id 1 in between don't make up for id 0's missed ones.
+	p.recentEvents = nil
+	for n := 0; n < 8; n++ {
+		p.ParseWith([]dsp.Packet{packet(&p, 0x80, 0, 0, 0x2D, 0x30)}, p.Discriminated)
+		now = now.Add(period)
+		p.ParseWith([]dsp.Packet{packet(&p, 0x81, 0, 0, 0x2D, 0x30)}, p.Discriminated)
+		now = now.Add(period)
+	}
+	if efficiency := p.HopEfficiency(); math.Abs(efficiency-8.0/16) > 1e-9 {
+		t.Fatalf("two ids: got %v, want %v", efficiency, 8.0/16)
+	}
+}
+
+func TestDecodeInto(t *testing.T) {
+	pkts := []dsp.Packet{
+		{Idx: 1, Data: []byte{0, 0, 0xE2, 4, 0x40, 0x85, 0, 0, 0x12, 0x34}},
+		{Idx: 2, Data: []byte{0, 0, 0x80, 5, 0x80, 0x2D, 0x30, 0, 0x56, 0x78}},
+	}
+
+	var m Message
+	for idx, pkt := range pkts {
+		if err := DecodeInto(pkt, &m); err != nil {
+			t.Fatal(err)
+		}
+		want := NewMessage(pkt)
+		if m.Idx != want.Idx || !bytes.Equal(m.Data, want.Data) || m.ID != want.ID || m.Sensor != want.Sensor ||
+			m.WindSpeed != want.WindSpeed || m.WindDirection != want.WindDirection || m.Collector != want.Collector ||
+			m.RotationSlot() != -1 {
+			t.Fatalf("packet %d: got %+v, want %+v", idx, m, want)
+		}
+	}
+
+	// The buffer is reused rather than reallocated.
+	data := m.Data
+	if err := DecodeInto(pkts[0], &m); err != nil {
+		t.Fatal(err)
+	}
+	if &m.Data[0] != &data[0] {
+		t.Fatal("buffer was reallocated")
+	}
+
+	if err := DecodeInto(dsp.Packet{Data: make([]byte, 6)}, &m); err == nil {
+		t.Fatal("expected error for short packet")
+	}
+}
+
+func BenchmarkNewMessage(b *testing.B) {
+	pkt := dsp.Packet{Data: []byte{0, 0, 0x80, 5, 0x80, 0x2D, 0x30, 0, 0x56, 0x78}}
+
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		NewMessage(pkt)
+	}
+}
+
+func BenchmarkDecodeInto(b *testing.B) {
+	pkt := dsp.Packet{Data: []byte{0, 0, 0x80, 5, 0x80, 0x2D, 0x30, 0, 0x56, 0x78}}
+
+	var m Message
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		DecodeInto(pkt, &m)
+	}
+}
+
+func TestCorrectedHopFrequencies(t *testing.T) {
+	p := NewParser(14, 0)
+	p.channelFreqErr[4] = 1200
+	p.channelFreqErr[2] = -800
+
+	freqs := p.CorrectedHopFrequencies()
+	if len(freqs) != len(EU.HopPattern) {
+		t.Fatalf("got %d frequencies, want %d", len(freqs), len(EU.HopPattern))
+	}
+
+	for idx, channelIdx := range EU.HopPattern {
+		want := EU.Channels[channelIdx]
+		switch channelIdx {
+		case 4:
+			want += 1200
+		case 2:
+			want -= 800
+		}
+		if freqs[idx] != want {
+			t.Errorf("hop %d: got %d, want %d", idx, freqs[idx], want)
+		}
+	}
+}
+
+func TestRainRateClicks(t *testing.T) {
+	// Light rain, 1 * 250 + 0x2C = 294 seconds between clicks.
+	msg := message(0x50, 0, 0, 0x2C, 0x50)
+	msg.Options.RainBucket = Bucket02mm
+
+	clicks, ok := msg.RainRateClicks()
+	if !ok || math.Abs(clicks-3600.0/294) > 1e-9 {
+		t.Fatalf("got (%v, %v), want (%v, true)", clicks, ok, 3600.0/294)
+	}
+	if mm, _ := msg.RainRateMM(); math.Abs(mm-clicks*0.2) > 1e-9 {
+		t.Fatalf("got %v mm/hr, want %v", mm, clicks*0.2)
+	}
+
+	if _, ok := message(0x80, 0, 0, 0x2C, 0x50).RainRateClicks(); ok {
+		t.Fatal("temperature decoded as rain rate")
+	}
+}
+
+func TestResyncSequential(t *testing.T) {
+	p := NewParser(14, 0)
+	p.Resync = ResyncSequential
+	p.ResyncBackoff = time.Second
+
+	cycle := 52 * p.DwellTime
+	for n := 0; n < 2*len(EU.Channels); n++ {
+		if hop := p.RandHop(); hop.ChannelIdx != n%len(EU.Channels) {
+			t.Fatalf("resync %d: got channel %d, want %d", n, hop.ChannelIdx, n%len(EU.Channels))
+		}
+		if dwell, want := p.ResyncDwell(), cycle+time.Duration(n)*time.Second; dwell != want {
+			t.Fatalf("resync %d: got dwell %s, want %s", n, dwell, want)
+		}
+	}
+
+	// Receiving a packet resets the backoff.
+	p.ParseWith([]dsp.Packet{packet(&p, 0x80, 0, 0, 0x2D, 0x30)}, p.Discriminated)
+	p.RandHop()
+	if dwell := p.ResyncDwell(); dwell != cycle {
+		t.Fatalf("after reception: got dwell %s, want %s", dwell, cycle)
+	}
+}
+
+func TestPlausible(t *testing.T) {
+	for _, tc := range []struct {
+		msg       Message
+		plausible bool
+	}{
+		// 72.3°F and 150.0°F.
+		{message(0x80, 5, 0x40, 0x2D, 0x30), true},
+		{message(0x80, 5, 0x40, 0x5D, 0xC0), true},
+		// -204.8°F, a bit error in the high byte.
+		{message(0x80, 5, 0x40, 0x80, 0x00), false},
+		// 57.4% and 102.4%.
+		{message(0xA0, 5, 0x40, 0x3E, 0x20), true},
+		{message(0xA0, 5, 0x40, 0x00, 0x40), false},
+		// Wind beyond any recorded gust.
+		{message(0x80, 240, 0x40, 0x2D, 0x30), false},
+		// No limits for the supercap.
+		{message(0x20, 5, 0x40, 0xFF, 0xC0), true},
+	} {
+		if got := tc.msg.Plausible(); got != tc.plausible {
+			value, _ := tc.msg.Value()
+			t.Errorf("%02X (%v): got %v, want %v", tc.msg.Data, value, got, tc.plausible)
+		}
+	}
+}
+
+func TestMultiRegion(t *testing.T) {
+	custom := Region{
+		Name:         "Custom",
+		Channels:     []int{869000000, 869100000, 869200000},
+		HopPattern:   []int{2, 0, 1},
+		SymbolLength: 14,
+		SyncWord:     SyncWord,
+	}
+
+	p, err := NewMultiRegionParser([]Region{EU, custom}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg := p.Config(); cfg.Region != "EU+Custom" || len(cfg.Channels) != 12 || len(cfg.HopPattern) != 12 {
+		t.Fatalf("got %+v", cfg)
+	}
+
+	for _, tc := range []struct {
+		patternIdx int
+		freq       int
+		region     string
+	}{
+		{1, EU.Channels[4], "EU"},
+		{9, custom.Channels[2], "Custom"},
+		{11, custom.Channels[1], "Custom"},
+	} {
+		hop, err := p.HopTo(tc.patternIdx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hop.ChannelFreq != tc.freq {
+			t.Fatalf("hop %d: got %d Hz, want %d Hz", tc.patternIdx, hop.ChannelFreq, tc.freq)
+		}
+
+		msgs := p.ParseWith([]dsp.Packet{packet(&p, 0x80, byte(tc.patternIdx), 0, 0x2D, 0x30)}, p.Discriminated)
+		if len(msgs) != 1 || msgs[0].Region != tc.region {
+			t.Fatalf("hop %d: got %+v, want region %s", tc.patternIdx, msgs, tc.region)
+		}
+	}
+
+	custom.SymbolLength = 10
+	if _, err := NewMultiRegionParser([]Region{EU, custom}, 0); err == nil {
+		t.Fatal("expected error for mismatched packet parameters")
+	}
+
+	single := NewParser(14, 0)
+	if msgs := single.ParseWith([]dsp.Packet{packet(&single, 0x80, 0, 0, 0x2D, 0x30)}, single.Discriminated); msgs[0].Region != "EU" {
+		t.Fatalf("single region: got %q, want EU", msgs[0].Region)
+	}
+}
+
+func TestExtraTemperature(t *testing.T) {
+	air := message(0x80, 0, 0, 0x2D, 0x30)
+	extra := message(0xC0, 0, 0, 0x1F, 0x40)
+
+	for _, tc := range []struct {
+		msg   Message
+		probe int
+		temp  float64
+	}{
+		{air, 0, 72.3},
+		{extra, 1, 50},
+	} {
+		probe, ok := tc.msg.TemperatureProbe()
+		if !ok || probe != tc.probe {
+			t.Fatalf("%s: got probe (%v, %v), want (%v, true)", tc.msg.Sensor, probe, ok, tc.probe)
+		}
+		if temp, ok := tc.msg.Temperature(); !ok || temp != tc.temp {
+			t.Fatalf("%s: got (%v, %v), want (%v, true)", tc.msg.Sensor, temp, ok, tc.temp)
+		}
+	}
+
+	agg := NewAggregator()
+	agg.Add(air)
+	agg.Add(extra)
+
+	obs := agg.Latest(0)
+	if obs.Temperature.Value != 72.3 || obs.ExtraTemperature.Value != 50 {
+		t.Fatalf("got air %v and extra %v, want 72.3 and 50", obs.Temperature.Value, obs.ExtraTemperature.Value)
+	}
+
+	if _, ok := message(0xA0, 0, 0, 0x2D, 0x30).TemperatureProbe(); ok {
+		t.Fatal("humidity reported a temperature probe")
+	}
+}
+
+func TestClockDrift(t *testing.T) {
+	p := NewParser(14, 0)
+
+	// The wall clock jumps around as if blocks were read in bursts, drift
+	// comes from the sample stream alone.
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.SetClock(func() time.Time { return now })
+
+	// A transmitter running 50ppm slow, with a couple of missed packets.
+	// Each packet lands part way through a block.
+	slow := TransmitterPeriod(1).Seconds() * float64(p.Cfg.SampleRate) * (1 + 50e-6)
+	for n := 0; n < 100; n++ {
+		sample := int64(float64(n) * slow)
+		rem := sample % int64(p.Cfg.BlockSize)
+		p.samples.Advance(int(sample - rem - p.samples.offset))
+
+		if n%7 != 3 {
+			pkt := packet(&p, 0x81, byte(n), 0, 0x2D, 0x30)
+			pkt.Idx = p.Cfg.BufferLength + int(rem)
+			p.ParseWith([]dsp.Packet{pkt}, p.Discriminated)
+		}
+		now = now.Add(time.Duration(n%3) * 100 * time.Millisecond)
+	}
+
+	if drift := p.ClockDrift(1); math.Abs(drift-50) > 0.5 {
+		t.Fatalf("got drift %v ppm, want 50", drift)
+	}
+	if drift := p.ClockDrift(2); drift != 0 {
+		t.Fatalf("unknown transmitter: got drift %v ppm, want 0", drift)
+	}
+}
+
+func TestSampleClock(t *testing.T) {
+	p := NewParser(14, 0)
+
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.SetClock(func() time.Time { return now })
+
+	block := make([]byte, p.Cfg.BlockSize2)
+	for n := 0; n < 3; n++ {
+		p.Demodulate(block)
+		now = now.Add(time.Second)
+	}
+
+	// The end of the third block, regardless of the wall clock.
+	want := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC).Add(3 * time.Duration(p.Cfg.BlockSize) * time.Second / time.Duration(p.Cfg.SampleRate))
+	if got := p.sampleTime(p.Cfg.BufferLength); !got.Equal(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestLeafWetness(t *testing.T) {
+	for _, tc := range []struct {
+		msg     Message
+		wetness int
+	}{
+		{message(0xF1, 0x31, 0, 0x00, 0x00), 0},
+		{message(0xF1, 0x31, 0, 0x7F, 0xC0), 7},
+		{message(0xF1, 0x32, 0, 0xF0, 0x00), 15},
+		{message(0xF1, 0x32, 0, 0xFF, 0x80), 15},
+	} {
+		if wetness, ok := tc.msg.LeafWetness(); !ok || wetness != tc.wetness {
+			t.Errorf("%02X: got (%v, %v), want (%v, true)", tc.msg.Data, wetness, ok, tc.wetness)
+		}
+	}
+
+	if _, ok := message(0xF1, 0x31, 0, 0xFF, 0xC0).LeafWetness(); ok {
+		t.Error("disconnected sensor should not decode")
+	}
+	if _, ok := message(0xF1, 0x11, 0, 0x48, 0x00).LeafWetness(); ok {
+		t.Error("soil temperature decoded as leaf wetness")
+	}
+}
+
+func TestLeafTemperature(t *testing.T) {
+	// Reading of 540 counts, 95F, on port 1.
+	msg := message(0xF1, 0x41, 0, 0x87, 0x00)
+	if f, ok := msg.LeafTemperatureF(); !ok || f != 95 {
+		t.Fatalf("got (%v, %v), want (95, true)", f, ok)
+	}
+	if _, ok := msg.SoilTemperatureF(); ok {
+		t.Fatal("leaf temperature decoded as soil temperature")
+	}
+
+	if _, ok := message(0xF1, 0x11, 0, 0x87, 0x00).LeafTemperatureF(); ok {
+		t.Fatal("soil temperature decoded as leaf temperature")
+	}
+	if _, ok := message(0xF1, 0x41, 0, 0xFF, 0xC0).LeafTemperatureF(); ok {
+		t.Fatal("disconnected probe should not decode")
+	}
+}
+
+func TestPoolBuffers(t *testing.T) {
+	p := NewParser(14, 0)
+	p.PoolBuffers = true
+
+	parse := func(payload ...byte) Message {
+		msgs := p.ParseWith([]dsp.Packet{packet(&p, payload...)}, p.Discriminated)
+		if len(msgs) != 1 {
+			t.Fatalf("got %d messages, want 1", len(msgs))
+		}
+		return msgs[0]
+	}
+
+	first := parse(0x80, 1, 0, 0x2D, 0x30)
+	second := parse(0xA0, 2, 0, 0x3E, 0x20)
+	want := append([]byte(nil), second.Data...)
+
+	p.Release(first)
+	for n := 0; n < 8; n++ {
+		msg := parse(0x60, byte(n), 0, 0x7D, 0x00)
+		if msg.Sensor != SolarRadiation || msg.WindSpeed != byte(n) {
+			t.Fatalf("pooled message %d: got %s", n, msg)
+		}
+		p.Release(msg)
+	}
+
+	// Messages which haven't been released are untouched by reuse.
+	if !bytes.Equal(second.Data, want) {
+		t.Fatalf("unreleased message changed: got %02X, want %02X", second.Data, want)
+	}
+	if humidity, _ := second.Humidity(); humidity != 57.4 {
+		t.Fatalf("got humidity %v, want 57.4", humidity)
+	}
+
+	// Messages which weren't pooled are ignored.
+	p.Release(message(0x80, 1, 0, 0x2D, 0x30))
+
+	// Held readings belong to the parser until returned, the repeat on the
+	// second channel is released and reused by the next reading.
+	p.RepeatWindow = time.Hour
+	for _, patternIdx := range []int{0, 1} {
+		p.HopTo(patternIdx)
+		p.ParseWith([]dsp.Packet{packet(&p, 0x80, 3, 0, 0x2D, 0x30)}, p.Discriminated)
+	}
+	p.ParseWith([]dsp.Packet{packet(&p, 0xA0, 4, 0, 0x3E, 0x20)}, p.Discriminated)
+
+	held := p.FlushRepeats()
+	if len(held) != 2 {
+		t.Fatalf("got %d held messages, want 2", len(held))
+	}
+	if temp, _ := held[0].Temperature(); temp != 72.3 || held[0].WindSpeed != 3 || held[0].RepeatCount != 2 {
+		t.Fatalf("held temperature: got %s with RepeatCount %d", held[0], held[0].RepeatCount)
+	}
+	if humidity, _ := held[1].Humidity(); humidity != 57.4 || held[1].WindSpeed != 4 {
+		t.Fatalf("held humidity: got %s", held[1])
+	}
+	for _, msg := range held {
+		p.Release(msg)
+	}
+}
+
+func BenchmarkParsePooled(b *testing.B) {
+	p := NewParser(14, 0)
+	p.PoolBuffers = true
+
+	var pkts []dsp.Packet
+	for n := 0; n < 16; n++ {
+		pkt := packet(&p, 0x81, byte(n), 0, 0x02, 0xD3)
+		pkts = append(pkts, pkt, pkt)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		for _, msg := range p.Parse(pkts) {
+			p.Release(msg)
+		}
+	}
+}
+
+func TestSoilMoisture(t *testing.T) {
+	// Reading of 320 counts, 10 kOhm, on port 1.
+	msg := message(0xF1, 0x21, 0, 0x50, 0x00)
+	want := (4.093 + 3.213*10) / (1 - 0.009733*10 - 0.01205*24)
+
+	if cb, ok := msg.SoilMoistureCB(); !ok || math.Abs(cb-want) > 1e-9 {
+		t.Fatalf("got (%v, %v), want (%v, true)", cb, ok, want)
+	}
+	if cb, ok := message(0xF1, 0x21, 0, 0xFF, 0x80).SoilMoistureCB(); !ok || cb != 200 {
+		t.Fatalf("dry probe: got (%v, %v), want (200, true)", cb, ok)
+	}
+
+	if _, ok := message(0xF1, 0x21, 0, 0xFF, 0xC0).SoilMoistureCB(); ok {
+		t.Fatal("disconnected probe should not decode")
+	}
+	if _, ok := message(0xF1, 0x11, 0, 0x50, 0x00).SoilMoistureCB(); ok {
+		t.Fatal("soil temperature decoded as soil moisture")
+	}
+}
+
+func TestCSVRow(t *testing.T) {
+	if header := strings.Join(CSVHeader(), ","); header != "time,id,sensor,value" {
+		t.Fatalf("got header %q", header)
+	}
+
+	msg := message(0x81, 0, 0, 0x2D, 0x30)
+	msg.Time = time.Date(2015, 6, 1, 0, 0, 0, 500000000, time.UTC)
+	if row := strings.Join(msg.CSVRow(), ","); row != "2015-06-01T00:00:00.5Z,1,Temperature,72.3" {
+		t.Fatalf("got row %q", row)
+	}
+
+	// A disconnected UV sensor has no value and the message no time.
+	msg = message(0x41, 0, 0, 0xFF, 0xC0)
+	if row := msg.CSVRow(); len(row) != len(CSVHeader()) || strings.Join(row, ",") != ",1,UV Index," {
+		t.Fatalf("got row %q", row)
+	}
+
+	// Gusts and rain are decoded, supercap voltage has no decode.
+	for _, tc := range []struct {
+		msg Message
+		row string
+	}{
+		{message(0x91, 0, 0, 0x10, 0x00), ",1,Wind Gust Speed,16"},
+		{message(0xE1, 0, 0, 0x10, 0x00), ",1,Rain,16"},
+		{message(0x21, 0, 0, 0x5A, 0x48), ",1,SuperCap Voltage,"},
+	} {
+		if row := strings.Join(tc.msg.CSVRow(), ","); row != tc.row {
+			t.Errorf("got row %q, want %q", row, tc.row)
+		}
+	}
+}
+
+func TestRepeatCount(t *testing.T) {
+	p := NewParser(14, 0)
+	p.RepeatWindow = 10 * time.Second
+
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.SetClock(func() time.Time { return now })
+
+	// The same reading on three channels, twice on the last, and a
+	// different reading once.
+	for _, patternIdx := range []int{0, 1, 2, 2} {
+		p.HopTo(patternIdx)
+		if msgs := p.ParseWith([]dsp.Packet{packet(&p, 0x80, 3, 0, 0x2D, 0x30)}, p.Discriminated); len(msgs) != 0 {
+			t.Fatalf("hop %d: got %d messages before the window passed", patternIdx, len(msgs))
+		}
+		now = now.Add(time.Second)
+	}
+	p.ParseWith([]dsp.Packet{packet(&p, 0xA0, 3, 0, 0x3E, 0x20)}, p.Discriminated)
+
+	now = now.Add(7 * time.Second)
+	msgs := p.Parse(nil)
+	if len(msgs) != 1 || msgs[0].Sensor != Temperature || msgs[0].RepeatCount != 3 {
+		t.Fatalf("got %+v, want one temperature with RepeatCount 3", msgs)
+	}
+
+	msgs = p.FlushRepeats()
+	if len(msgs) != 1 || msgs[0].Sensor != Humidity || msgs[0].RepeatCount != 1 {
+		t.Fatalf("flush: got %+v, want one humidity with RepeatCount 1", msgs)
+	}
+
+	// Without a window every message is delivered once as it arrives.
+	p.RepeatWindow = 0
+	if msgs := p.ParseWith([]dsp.Packet{packet(&p, 0x80, 3, 0, 0x2D, 0x30)}, p.Discriminated); len(msgs) != 1 || msgs[0].RepeatCount != 1 {
+		t.Fatalf("no window: got %+v", msgs)
+	}
+}
+
+func TestUVDose(t *testing.T) {
+	now := time.Date(2015, 6, 1, 11, 0, 0, 0, time.UTC)
+
+	dose := NewUVDose()
+	dose.SetClock(func() time.Time { return now })
+
+	// UV index 5 every 40 seconds for an hour, with a 10 minute gap.
+	uv := message(0x41, 0, 0, 0x3E, 0x80)
+	for elapsed := time.Duration(0); elapsed <= time.Hour; elapsed += 40 * time.Second {
+		if elapsed < 20*time.Minute || elapsed > 30*time.Minute {
+			dose.Add(uv)
+		}
+		now = now.Add(40 * time.Second)
+	}
+
+	// The hour less the 680 seconds between the readings either side of
+	// the gap.
+	want := 5 * 0.025 * (60*60 - 680)
+	if joules := dose.Joules(); math.Abs(joules-want) > 1e-9 {
+		t.Fatalf("got %v J/m^2, want %v", joules, want)
+	}
+	if med := dose.MED(); math.Abs(med-want/210) > 1e-9 {
+		t.Fatalf("got %v MED, want %v", med, want/210)
+	}
+
+	now = time.Date(2015, 6, 2, 0, 0, 1, 0, time.UTC)
+	if joules := dose.Joules(); joules != 0 {
+		t.Fatalf("next day: got %v J/m^2, want 0", joules)
+	}
+}
+
+func TestWindRun(t *testing.T) {
+	now := time.Date(2015, 6, 1, 11, 0, 0, 0, time.UTC)
+
+	run := NewWindRun()
+	run.SetClock(func() time.Time { return now })
+
+	// 10 mph every 2.5 seconds for an hour, interleaved with a transmitter
+	// without a wind sensor.
+	wind := message(0x80, 10, 0x40, 0x2D, 0x30)
+	for elapsed := time.Duration(0); elapsed <= time.Hour; elapsed += 2500 * time.Millisecond {
+		run.Add(wind)
+		run.Add(message(0x81, 0xFF, 0xFF, 0x2D, 0x30))
+		now = now.Add(2500 * time.Millisecond)
+	}
+
+	if miles := run.Miles(); math.Abs(miles-10) > 1e-9 {
+		t.Fatalf("got %v miles, want 10", miles)
+	}
+	if km := run.Km(); math.Abs(km-16.09344) > 1e-9 {
+		t.Fatalf("got %v km, want 16.09344", km)
+	}
+
+	// Speed isn't held across a gap longer than MaxGap.
+	now = now.Add(time.Hour)
+	run.Add(wind)
+	if miles := run.Miles(); math.Abs(miles-10) > 1e-9 {
+		t.Fatalf("after gap: got %v miles, want 10", miles)
+	}
+
+	now = time.Date(2015, 6, 2, 0, 0, 1, 0, time.UTC)
+	if miles := run.Miles(); miles != 0 {
+		t.Fatalf("next day: got %v miles, want 0", miles)
+	}
+}
+
+func TestValidatePlan(t *testing.T) {
+	p := NewParser(14, 0)
+	p.PlanMinVisits = 5
+
+	for channelIdx := range EU.Channels {
+		p.channelStats[channelIdx] = ChannelStats{Received: 8, Missed: 2}
+		p.channelFreqErr[channelIdx] = 1000 + channelIdx*100
+	}
+
+	// Channel 2 is visited often enough to be flagged, channel 5 isn't.
+	p.channelStats[2] = ChannelStats{Missed: 6}
+	delete(p.channelFreqErr, 2)
+	p.channelStats[5] = ChannelStats{Missed: 4}
+	delete(p.channelFreqErr, 5)
+
+	// Channel 7 learned a wild error.
+	p.channelFreqErr[7] = -9000
+
+	want := []PlanIssue{
+		{2, EU.Channels[2], PlanSilent},
+		{7, EU.Channels[7], PlanFreqErrAnomaly},
+	}
+	if issues := p.ValidatePlan(); fmt.Sprint(issues) != fmt.Sprint(want) {
+		t.Fatalf("got %v, want %v", issues, want)
+	}
+}
+
+func TestRainRateHighRes(t *testing.T) {
+	for _, tc := range []struct {
+		msg      Message
+		interval float64
+	}{
+		// 350 sixteenths of a second, bit 7 doesn't change the units.
+		{message(0x51, 0, 0, 0x64, 0x10), 350.0 / 16},
+		{message(0x51, 0, 0, 0x64, 0x90), 350.0 / 16},
+		{message(0x51, 0, 0, 0x64, 0xD0), 350},
+	} {
+		if clicks, ok := tc.msg.RainRateClicks(); !ok || math.Abs(clicks-3600/tc.interval) > 1e-9 {
+			t.Errorf("%02X: got (%v, %v), want (%v, true)", tc.msg.Data, clicks, ok, 3600/tc.interval)
+		}
+	}
+}
+
+func TestSaveLoadState(t *testing.T) {
+	p := NewParser(14, 0)
+
+	discriminated := make([]float64, len(p.Discriminated))
+	for idx := range discriminated {
+		discriminated[idx] = -2 * math.Pi * (9600 + 700) / float64(p.Cfg.SampleRate)
+	}
+	for _, patternIdx := range []int{2, 5} {
+		p.HopTo(patternIdx)
+		p.ParseWith([]dsp.Packet{packet(&p, 0x80, byte(patternIdx), 0, 0x2D, 0x30)}, discriminated)
+	}
+	p.Missed()
+
+	restored := NewParser(14, 0)
+	if err := restored.LoadState(p.SaveState()); err != nil {
+		t.Fatal(err)
+	}
+
+	if restored.hopIdx != p.hopIdx || restored.hop() != p.hop() {
+		t.Fatalf("got hop %s at %d, want %s at %d", restored.hop(), restored.hopIdx, p.hop(), p.hopIdx)
+	}
+	for channelIdx := range EU.Channels {
+		got, gotOk := restored.FreqErrorForChannel(channelIdx)
+		want, wantOk := p.FreqErrorForChannel(channelIdx)
+		if got != want || gotOk != wantOk {
+			t.Fatalf("channel %d: got (%d, %v), want (%d, %v)", channelIdx, got, gotOk, want, wantOk)
+		}
+		if restored.ChannelStats(channelIdx) != p.ChannelStats(channelIdx) {
+			t.Fatalf("channel %d: got stats %+v, want %+v", channelIdx, restored.ChannelStats(channelIdx), p.ChannelStats(channelIdx))
+		}
+	}
+
+	agg := NewAggregator()
+	msg := message(0x81, 5, 0x80, 0x2D, 0x30)
+	msg.Time = time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+	agg.Add(msg)
+
+	restoredAgg := NewAggregator()
+	if err := restoredAgg.LoadState(agg.SaveState()); err != nil {
+		t.Fatal(err)
+	}
+	if obs := restoredAgg.Latest(1); obs.Temperature.Value != 72.3 || !obs.Temperature.Time.Equal(msg.Time) {
+		t.Fatalf("got %+v", obs.Temperature)
+	}
+
+	state := strings.Replace(string(p.SaveState()), `"Version":1`, `"Version":99`, 1)
+	if err := restored.LoadState([]byte(state)); err == nil || !strings.Contains(err.Error(), "version 99") {
+		t.Fatalf("got %v, want version error", err)
+	}
+
+	us, _ := NewRegionParser(US, 0)
+	if err := us.LoadState(p.SaveState()); err == nil {
+		t.Fatal("expected error loading EU state into a US parser")
+	}
+}
+
+func TestGustWindow(t *testing.T) {
+	now := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	gusts := NewGustWindow(10 * time.Minute)
+	gusts.SetClock(func() time.Time { return now })
+
+	if _, ok := gusts.Peak(); ok {
+		t.Fatal("empty window reported a peak")
+	}
+
+	start := now
+	for _, tc := range []struct {
+		minute int
+		gust   byte
+		peak   float64
+	}{
+		{0, 12, 12},
+		{2, 18, 18},
+		{4, 31, 31},
+		{6, 15, 31},
+		{10, 20, 31},
+		// The 31mph gust is now 12 minutes old.
+		{16, 14, 20},
+		{27, 9, 9},
+	} {
+		now = start.Add(time.Duration(tc.minute) * time.Minute)
+		gusts.Add(message(0x90, 0, 0, tc.gust, 0x00))
+		gusts.Add(message(0x80, 40, 0, 0x2D, 0x30))
+
+		if peak, ok := gusts.Peak(); !ok || peak != tc.peak {
+			t.Fatalf("minute %d: got (%v, %v), want (%v, true)", tc.minute, peak, ok, tc.peak)
+		}
+	}
+}
+
+func TestShortHopPattern(t *testing.T) {
+	region := EU
+	region.HopPattern = []int{0, 4, 8}
+
+	p, err := NewRegionParser(region, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for n := 0; n < 4*len(EU.Channels); n++ {
+		for _, hop := range []Hop{p.NextHop(), p.RandHop()} {
+			if hop.ChannelIdx != 0 && hop.ChannelIdx != 4 && hop.ChannelIdx != 8 {
+				t.Fatalf("hopped to channel %d outside the pattern", hop.ChannelIdx)
+			}
+		}
+		p.Missed()
+		p.ParseWith([]dsp.Packet{packet(&p, 0x80, 0, 0, 0x2D, 0x30)}, p.Discriminated)
+	}
+
+	p.Resync = ResyncSequential
+	for _, want := range []int{0, 4, 8, 0} {
+		if hop := p.RandHop(); hop.ChannelIdx != want {
+			t.Fatalf("sequential resync: got channel %d, want %d", hop.ChannelIdx, want)
+		}
+	}
+
+	for _, pattern := range [][]int{nil, {0, 9}, {-1}} {
+		region.HopPattern = pattern
+		if _, err := NewRegionParser(region, 0); err == nil {
+			t.Errorf("pattern %v: expected error", pattern)
+		}
+	}
+}
+
+func TestChargeCurrent(t *testing.T) {
+	for _, msg := range []Message{
+		message(0x20, 0, 0, 0x5A, 0x48),
+		message(0x20, 0, 0, 0x5A, 0x40),
+	} {
+		if _, ok := msg.ChargeCurrent(); ok {
+			t.Errorf("%02X: decoded a charge current", msg.Data)
+		}
+	}
+}
+
+func TestParseGrouped(t *testing.T) {
+	p := NewParser(14, 0)
+
+	bad := packet(&p, 0x80, 9, 0, 0x2D, 0x30)
+	bad.Data[4] ^= 0x01
+
+	groups := p.ParseGrouped([]dsp.Packet{
+		packet(&p, 0x80, 1, 0, 0x2D, 0x30),
+		packet(&p, 0xE0, 2, 0, 0x10, 0x00),
+		packet(&p, 0x80, 3, 0, 0x2D, 0x40),
+		packet(&p, 0xA0, 4, 0, 0x3E, 0x20),
+		packet(&p, 0xE0, 5, 0, 0x11, 0x00),
+		packet(&p, 0x80, 6, 0, 0x2D, 0x50),
+		bad,
+	})
+
+	if len(groups) != 3 || len(groups[Temperature]) != 3 || len(groups[Rain]) != 2 || len(groups[Humidity]) != 1 {
+		t.Fatalf("got %v", groups)
+	}
+	for idx, msg := range groups[Temperature] {
+		if msg.Sensor != Temperature || msg.WindSpeed != []byte{1, 3, 6}[idx] {
+			t.Fatalf("temperature %d: got %s", idx, msg)
+		}
+	}
+}
+
+func TestWindSpeedHighRange(t *testing.T) {
+	// Speed and gust are single bytes, Data[5] doesn't extend them.
+	for _, tc := range []struct {
+		msg         Message
+		speed, gust float64
+		gustDecoded bool
+	}{
+		{message(0x90, 20, 0x40, 0x2C, 0x00, 0x00), 20, 0x2C, true},
+		{message(0x90, 20, 0x40, 0x2C, 0x00, 0x30), 20, 0x2C, true},
+		{message(0x90, 255, 0x40, 0xFF, 0x00, 0x00), 255, 255, true},
+		{message(0x80, 20, 0x40, 0x2C, 0x00, 0x30), 20, 0, false},
+	} {
+		if speed, ok := tc.msg.WindSpeedMPH(); !ok || speed != tc.speed {
+			t.Errorf("%02X: got speed (%v, %v), want (%v, true)", tc.msg.Data, speed, ok, tc.speed)
+		}
+		if gust, ok := tc.msg.WindGustMPH(); ok != tc.gustDecoded || gust != tc.gust {
+			t.Errorf("%02X: got gust (%v, %v), want (%v, %v)", tc.msg.Data, gust, ok, tc.gust, tc.gustDecoded)
+		}
+	}
+
+	stats := NewWindStats()
+	stats.Add(message(0x80, 20, 0x40, 0x2D, 0x30, 0x20))
+	if s := stats.Summary(0); s.MeanSpeed != 20 || s.MaxSpeed != 20 {
+		t.Fatalf("got mean %v and max %v, want 20", s.MeanSpeed, s.MaxSpeed)
+	}
+	if !message(0x80, 0, 0x40, 0x2D, 0x30, 0x20).IsCalm() {
+		t.Fatal("0 mph isn't calm")
+	}
+}
+
+func TestExtendedWindDirection(t *testing.T) {
+	for _, flags := range []byte{0x00, 0x80, 0xC0} {
+		msg := message(0x80, 5, 0x40, 0x2D, 0x30, flags)
+		if _, ok := msg.ExtendedWindDirection(); ok {
+			t.Errorf("%02X: extended wind direction decoded", msg.Data)
+		}
+		if dir, ok := msg.WindDirectionDegrees(); !ok || math.Abs(dir-(9+0x40*342.0/255)) > 1e-9 {
+			t.Errorf("%02X: got (%v, %v), want (%v, true)", msg.Data, dir, ok, 9+0x40*342.0/255)
+		}
+	}
+}
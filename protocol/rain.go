@@ -0,0 +1,90 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package protocol
+
+type rainKey struct {
+	ID        byte
+	Collector byte
+}
+
+// RainAccumulator totals bucket tips from the wrapping counter in Rain
+// messages, separately for each transmitter and collector.
+//
+// A power cycled transmitter restarts its counter from zero, which would read
+// as a wrap and a burst of rain. A counter which drops, wrapping by more than
+// ResetThreshold tips since the previous message, is held as a suspected
+// reset: if the next message counts on from the new value the reset is
+// confirmed and only the tips since it are added, otherwise the drop is
+// discarded as a corrupt packet. Resets from within ResetThreshold of the
+// wrap can't be told from rain.
+type RainAccumulator struct {
+	ResetThreshold int
+
+	last   map[rainKey]int
+	totals map[rainKey]int
+	resets map[rainKey]int
+}
+
+func NewRainAccumulator() *RainAccumulator {
+	return &RainAccumulator{
+		ResetThreshold: 16,
+		last:           make(map[rainKey]int),
+		totals:         make(map[rainKey]int),
+		resets:         make(map[rainKey]int),
+	}
+}
+
+// Add accumulates the tips since the collector's previous message and
+// returns them. The first message from a collector only sets its baseline.
+func (r *RainAccumulator) Add(msg Message) int {
+	clicks, ok := msg.RainClicks()
+	if !ok {
+		return 0
+	}
+
+	key := rainKey{msg.ID, msg.Collector}
+	last, seen := r.last[key]
+	if !seen {
+		r.last[key] = clicks
+		return 0
+	}
+
+	if reset, suspected := r.resets[key]; suspected {
+		delete(r.resets, key)
+		if since := (clicks - reset) & rainCounterMask; since <= r.ResetThreshold {
+			r.last[key] = clicks
+			r.totals[key] += since
+			return since
+		}
+	}
+
+	delta := (clicks - last) & rainCounterMask
+	if clicks < last && delta > r.ResetThreshold {
+		r.resets[key] = clicks
+		return 0
+	}
+
+	r.last[key] = clicks
+	r.totals[key] += delta
+	return delta
+}
+
+// Clicks returns the total tips accumulated from a transmitter's collector.
+func (r *RainAccumulator) Clicks(id, collector byte) int {
+	return r.totals[rainKey{id, collector}]
+}
@@ -0,0 +1,80 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package protocol
+
+import "time"
+
+// heldRepeat is a reading held to count the channels delivering it.
+type heldRepeat struct {
+	msg      Message
+	hash     uint64
+	channels map[int]bool
+	until    time.Time
+}
+
+// holdRepeat holds a new reading, or counts the channel if the reading is
+// already held.
+func (p *Parser) holdRepeat(msg Message, channelIdx int) {
+	h := fnv64a(msg.Data)
+	for idx := range p.repeats {
+		held := &p.repeats[idx]
+		if held.hash == h && held.msg.ID == msg.ID {
+			if !held.channels[channelIdx] {
+				held.channels[channelIdx] = true
+				held.msg.RepeatCount++
+			}
+			p.Release(msg)
+			return
+		}
+	}
+
+	p.repeats = append(p.repeats, heldRepeat{
+		msg:      msg,
+		hash:     h,
+		channels: map[int]bool{channelIdx: true},
+		until:    msg.Time.Add(p.RepeatWindow),
+	})
+}
+
+// expiredRepeats removes and returns the held readings whose window has
+// passed, oldest first.
+func (p *Parser) expiredRepeats() (msgs []Message) {
+	now := p.now()
+
+	held := p.repeats[:0]
+	for _, r := range p.repeats {
+		if now.Before(r.until) {
+			held = append(held, r)
+			continue
+		}
+		msgs = append(msgs, r.msg)
+	}
+	p.repeats = held
+
+	return msgs
+}
+
+// FlushRepeats returns every held reading regardless of its window.
+func (p *Parser) FlushRepeats() (msgs []Message) {
+	for _, r := range p.repeats {
+		msgs = append(msgs, r.msg)
+	}
+	p.repeats = p.repeats[:0]
+
+	return msgs
+}
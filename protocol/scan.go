@@ -0,0 +1,90 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package protocol
+
+import (
+	"context"
+	"io"
+	"sort"
+	"time"
+)
+
+// Tuner is a receiver which can be tuned and read samples from. Samples are
+// interleaved 8-bit I/Q as produced by rtl-sdr.
+type Tuner interface {
+	io.Reader
+	SetCenterFreq(freq int) error
+}
+
+// ChannelEnergy is the mean power of the filtered signal on a channel.
+type ChannelEnergy struct {
+	ChannelIdx  int
+	ChannelFreq int
+	Energy      float64
+}
+
+type byEnergy []ChannelEnergy
+
+func (c byEnergy) Len() int           { return len(c) }
+func (c byEnergy) Less(i, j int) bool { return c[i].Energy > c[j].Energy }
+func (c byEnergy) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// ScanChannels tunes to each channel in turn, applying its frequency error,
+// and measures the energy received over dwell worth of samples. Channels are
+// returned strongest first. The hop sequence is left untouched.
+func (p *Parser) ScanChannels(ctx context.Context, tuner Tuner, dwell time.Duration) ([]ChannelEnergy, error) {
+	blocks := int(dwell * time.Duration(p.Cfg.SampleRate) / time.Second / time.Duration(p.Cfg.BlockSize))
+	if blocks < 1 {
+		blocks = 1
+	}
+
+	block := make([]byte, p.Cfg.BlockSize2)
+	energies := make([]ChannelEnergy, 0, len(p.channels))
+
+	for channelIdx, freq := range p.channels {
+		if err := tuner.SetCenterFreq(freq + p.channelFreqErr[channelIdx]); err != nil {
+			return nil, err
+		}
+		p.Demodulator.Reset()
+
+		var energy float64
+		for n := 0; n < blocks; n++ {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			default:
+			}
+
+			if _, err := io.ReadFull(tuner, block); err != nil {
+				return nil, err
+			}
+			p.Demodulate(block)
+
+			for _, sample := range p.Filtered[1:] {
+				energy += real(sample)*real(sample) + imag(sample)*imag(sample)
+			}
+		}
+		energy /= float64(blocks * (len(p.Filtered) - 1))
+
+		energies = append(energies, ChannelEnergy{channelIdx, freq, energy})
+	}
+
+	sort.Sort(byEnergy(energies))
+
+	return energies, nil
+}
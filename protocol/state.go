@@ -0,0 +1,156 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Version of the encoding produced by SaveState. Bump when the saved fields
+// change incompatibly.
+const stateVersion = 1
+
+// parserState is the runtime state of a Parser learned while receiving.
+type parserState struct {
+	Version int
+	Region  string
+
+	HopIdx         int
+	CurrentFreqErr int
+	ChannelFreqErr map[int]int
+	FreqErrDeltas  map[int][]int
+
+	ChannelDwell  map[int]time.Duration
+	ChannelMisses map[int]int
+	Disabled      map[int]time.Time
+
+	ChannelStats map[int]ChannelStats
+	LinkHistory  map[byte][]bool
+}
+
+// SaveState encodes the parser's runtime state: hop position, learned
+// frequency errors, dwell times, disabled channels and reception stats.
+// Configuration isn't included, LoadState expects a parser configured the
+// same way.
+func (p *Parser) SaveState() []byte {
+	data, err := json.Marshal(parserState{
+		Version:        stateVersion,
+		Region:         p.region.Name,
+		HopIdx:         p.hopIdx,
+		CurrentFreqErr: p.currentFreqErr,
+		ChannelFreqErr: p.channelFreqErr,
+		FreqErrDeltas:  p.freqErrDeltas,
+		ChannelDwell:   p.channelDwell,
+		ChannelMisses:  p.channelMisses,
+		Disabled:       p.disabled,
+		ChannelStats:   p.channelStats,
+		LinkHistory:    p.linkHistory,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// LoadState restores runtime state saved by SaveState. The parser is left
+// unchanged if the state can't be decoded or doesn't match its version and
+// region.
+func (p *Parser) LoadState(data []byte) error {
+	var state parserState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("invalid parser state: %s", err)
+	}
+	if state.Version != stateVersion {
+		return fmt.Errorf("parser state version %d is incompatible, want %d", state.Version, stateVersion)
+	}
+	if state.Region != p.region.Name {
+		return fmt.Errorf("parser state is for region %q, parser is %q", state.Region, p.region.Name)
+	}
+	if state.HopIdx < 0 || state.HopIdx >= len(p.hopPattern) {
+		return fmt.Errorf("parser state hop index %d out of range [0, %d)", state.HopIdx, len(p.hopPattern))
+	}
+
+	p.hopIdx = state.HopIdx
+	p.currentFreqErr = state.CurrentFreqErr
+	p.channelFreqErr = state.ChannelFreqErr
+	if p.channelFreqErr == nil {
+		p.channelFreqErr = make(map[int]int)
+	}
+	p.freqErrDeltas = state.FreqErrDeltas
+	if p.freqErrDeltas == nil {
+		p.freqErrDeltas = make(map[int][]int)
+	}
+	p.freqErrAt = make(map[int]time.Time)
+	p.channelDwell = state.ChannelDwell
+	if p.channelDwell == nil {
+		p.channelDwell = make(map[int]time.Duration)
+	}
+	p.channelMisses = state.ChannelMisses
+	if p.channelMisses == nil {
+		p.channelMisses = make(map[int]int)
+	}
+	p.disabled = state.Disabled
+	if p.disabled == nil {
+		p.disabled = make(map[int]time.Time)
+	}
+	p.channelStats = state.ChannelStats
+	if p.channelStats == nil {
+		p.channelStats = make(map[int]ChannelStats)
+	}
+	p.linkHistory = state.LinkHistory
+	if p.linkHistory == nil {
+		p.linkHistory = make(map[byte][]bool)
+	}
+
+	return nil
+}
+
+// aggregatorState is the observations held by an Aggregator.
+type aggregatorState struct {
+	Version      int
+	Observations map[byte]Observation
+}
+
+// SaveState encodes the aggregator's observations. The most recent messages
+// returned by LastReadings aren't included.
+func (a *Aggregator) SaveState() []byte {
+	data, err := json.Marshal(aggregatorState{stateVersion, a.observations})
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// LoadState restores observations saved by SaveState.
+func (a *Aggregator) LoadState(data []byte) error {
+	var state aggregatorState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("invalid aggregator state: %s", err)
+	}
+	if state.Version != stateVersion {
+		return fmt.Errorf("aggregator state version %d is incompatible, want %d", state.Version, stateVersion)
+	}
+
+	a.observations = state.Observations
+	if a.observations == nil {
+		a.observations = make(map[byte]Observation)
+	}
+	return nil
+}
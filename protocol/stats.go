@@ -0,0 +1,295 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package protocol
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ChannelStats counts packets received and missed on a channel.
+type ChannelStats struct {
+	Received int
+	Missed   int
+}
+
+// SuccessRate returns the fraction of expected packets which were received.
+func (s ChannelStats) SuccessRate() float64 {
+	if s.Received+s.Missed == 0 {
+		return 0
+	}
+	return float64(s.Received) / float64(s.Received+s.Missed)
+}
+
+// ChannelStats returns the reception stats for the given channel index.
+func (p *Parser) ChannelStats(channelIdx int) ChannelStats {
+	return p.channelStats[channelIdx]
+}
+
+// ChannelCoverage describes reception on a single channel.
+type ChannelCoverage struct {
+	ChannelIdx  int
+	ChannelFreq int
+	ChannelStats
+}
+
+type byFrequency []ChannelCoverage
+
+func (c byFrequency) Len() int           { return len(c) }
+func (c byFrequency) Less(i, j int) bool { return c[i].ChannelFreq < c[j].ChannelFreq }
+func (c byFrequency) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// CoverageReport returns reception stats for every channel in order of
+// frequency. A run of adjacent channels with poor success rates suggests an
+// antenna null or filter problem rather than interference.
+func (p *Parser) CoverageReport() []ChannelCoverage {
+	report := make([]ChannelCoverage, len(p.channels))
+	for channelIdx, freq := range p.channels {
+		report[channelIdx] = ChannelCoverage{channelIdx, freq, p.channelStats[channelIdx]}
+	}
+	sort.Sort(byFrequency(report))
+
+	return report
+}
+
+func (p *Parser) recordLink(id byte, received bool) {
+	history := append(p.linkHistory[id], received)
+	if p.LinkWindow > 0 && len(history) > p.LinkWindow {
+		history = history[len(history)-p.LinkWindow:]
+	}
+	p.linkHistory[id] = history
+}
+
+// LinkQuality returns the fraction of the last LinkWindow expected packets
+// from the transmitter which were received. Misses are only known for the
+// transmitter the parser is listening for, since only its packets are
+// expected.
+func (p *Parser) LinkQuality(id byte) float64 {
+	history := p.linkHistory[id]
+	if len(history) == 0 {
+		return 0
+	}
+
+	received := 0
+	for _, r := range history {
+		if r {
+			received++
+		}
+	}
+	return float64(received) / float64(len(history))
+}
+
+// ParseStats counts packets parsed and missed.
+type ParseStats struct {
+	Valid       int
+	CRCFailures int
+	Missed      int
+}
+
+type eventKind byte
+
+const (
+	eventValid eventKind = iota
+	eventCRCFailure
+	eventMissed
+)
+
+// parseEvent records one packet or miss. ID is the packet's transmitter, or the
+// parser's own for misses, and can't be trusted for checksum failures.
+type parseEvent struct {
+	Time time.Time
+	Kind eventKind
+	ID   byte
+}
+
+// recordEvent appends an event, discarding those older than StatsRetention.
+func (p *Parser) recordEvent(kind eventKind, id byte) {
+	now := p.now()
+
+	expired := 0
+	for expired < len(p.recentEvents) && now.Sub(p.recentEvents[expired].Time) > p.StatsRetention {
+		expired++
+	}
+	p.recentEvents = append(p.recentEvents[expired:], parseEvent{now, kind, id})
+}
+
+// RecentStats returns the stats for events within window of now. Windows
+// longer than StatsRetention only count retained events.
+func (p *Parser) RecentStats(window time.Duration) (stats ParseStats) {
+	now := p.now()
+
+	for idx := len(p.recentEvents) - 1; idx >= 0; idx-- {
+		event := p.recentEvents[idx]
+		if now.Sub(event.Time) > window {
+			break
+		}
+
+		switch event.Kind {
+		case eventValid:
+			stats.Valid++
+		case eventCRCFailure:
+			stats.CRCFailures++
+		case eventMissed:
+			stats.Missed++
+		}
+	}
+
+	return stats
+}
+
+// HopEfficiency returns the valid packets from the parser's transmitter among
+// the retained events as a fraction of the packets it sent over the same span,
+// one every TransmitterPeriod. Packets from other transmitters aren't counted. With a good checksum rate, a persistently low
+// efficiency suggests the hop timing doesn't match the transmitter. Returns 0
+// until two events have been recorded.
+func (p *Parser) HopEfficiency() float64 {
+	if len(p.recentEvents) < 2 {
+		return 0
+	}
+
+	valid := 0
+	for _, event := range p.recentEvents {
+		if event.Kind == eventValid && event.ID == byte(p.ID) {
+			valid++
+		}
+	}
+
+	span := p.recentEvents[len(p.recentEvents)-1].Time.Sub(p.recentEvents[0].Time)
+	sent := float64(span/TransmitterPeriod(byte(p.ID)) + 1)
+
+	efficiency := float64(valid) / sent
+	if efficiency > 1 {
+		efficiency = 1
+	}
+	return efficiency
+}
+
+// arrivalTiming spans the packets received from a transmitter, timed by the
+// sample clock.
+type arrivalTiming struct {
+	first, last time.Time
+	periods     int
+}
+
+func (p *Parser) recordArrival(id byte, t time.Time) {
+	timing, exists := p.arrivals[id]
+	if !exists {
+		p.arrivals[id] = arrivalTiming{first: t, last: t}
+		return
+	}
+
+	// Count the whole periods since the last packet, missed packets
+	// included.
+	period := TransmitterPeriod(id)
+	periods := int((t.Sub(timing.last) + period/2) / period)
+	if periods < 1 {
+		return
+	}
+
+	timing.last = t
+	timing.periods += periods
+	p.arrivals[id] = timing
+}
+
+// NextExpected returns when the next packet from the transmitter is due, one
+// of its periods after the last received on the sample clock. Returns false if
+// none has been received.
+func (p *Parser) NextExpected(id byte) (time.Time, bool) {
+	timing, exists := p.arrivals[id]
+	if !exists {
+		return time.Time{}, false
+	}
+	return timing.last.Add(TransmitterPeriod(id)), true
+}
+
+// ClockDrift returns how far in ppm the transmitter's packet period is from
+// nominal, measured across all its packets by their position in the sample
+// stream rather than when they were parsed. Positive drift means a slow clock.
+// Returns 0 until two packets have been received.
+func (p *Parser) ClockDrift(id byte) float64 {
+	timing := p.arrivals[id]
+	if timing.periods == 0 {
+		return 0
+	}
+
+	period := TransmitterPeriod(id)
+	measured := timing.last.Sub(timing.first) / time.Duration(timing.periods)
+	return float64(measured-period) / float64(period) * 1e6
+}
+
+// PlanIssueKind is the kind of problem ValidatePlan found with a channel.
+type PlanIssueKind int
+
+const (
+	// The channel never received a packet.
+	PlanSilent PlanIssueKind = iota
+	// The channel's frequency error is far from the other channels'.
+	PlanFreqErrAnomaly
+)
+
+func (k PlanIssueKind) String() string {
+	switch k {
+	case PlanSilent:
+		return "Silent"
+	case PlanFreqErrAnomaly:
+		return "FreqErrAnomaly"
+	default:
+		return fmt.Sprintf("PlanIssueKind(%d)", int(k))
+	}
+}
+
+// PlanIssue is a channel whose reception doesn't fit the configured plan.
+type PlanIssue struct {
+	ChannelIdx  int
+	ChannelFreq int
+	Kind        PlanIssueKind
+}
+
+// ValidatePlan compares reception on each channel against the plan. Silent
+// channels suggest a wrong frequency, an anomalous frequency error suggests
+// the channel's frequency is off or was learned from a bad packet. Issues are
+// returned in order of channel index.
+func (p *Parser) ValidatePlan() (issues []PlanIssue) {
+	var freqErrs []int
+	for channelIdx := range p.channels {
+		if freqErr, exists := p.channelFreqErr[channelIdx]; exists {
+			freqErrs = append(freqErrs, freqErr)
+		}
+	}
+	sort.Ints(freqErrs)
+
+	for channelIdx, freq := range p.channels {
+		stats := p.channelStats[channelIdx]
+		if stats.Received == 0 && stats.Missed >= p.PlanMinVisits {
+			issues = append(issues, PlanIssue{channelIdx, freq, PlanSilent})
+			continue
+		}
+
+		freqErr, exists := p.channelFreqErr[channelIdx]
+		if !exists || len(freqErrs) < 3 {
+			continue
+		}
+		deviation := freqErr - freqErrs[len(freqErrs)/2]
+		if deviation > p.PlanFreqErrTolerance || deviation < -p.PlanFreqErrTolerance {
+			issues = append(issues, PlanIssue{channelIdx, freq, PlanFreqErrAnomaly})
+		}
+	}
+
+	return issues
+}
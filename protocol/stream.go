@@ -0,0 +1,52 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package protocol
+
+import "time"
+
+// Stream demodulates and parses each block of samples received from in and
+// sends the resulting messages to out. Stream returns and closes out once in
+// is closed.
+func (p *Parser) Stream(in <-chan []byte, out chan<- Message) {
+	defer close(out)
+
+	var idle <-chan time.Time
+	resetIdle := func() {
+		if p.IdleTimeout > 0 && p.OnIdle != nil {
+			idle = time.After(p.IdleTimeout)
+		}
+	}
+	resetIdle()
+
+	for {
+		select {
+		case block, ok := <-in:
+			if !ok {
+				return
+			}
+
+			for _, msg := range p.Parse(p.Demodulate(block)) {
+				out <- msg
+				resetIdle()
+			}
+		case <-idle:
+			p.OnIdle()
+			resetIdle()
+		}
+	}
+}
@@ -0,0 +1,57 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package protocol
+
+import "time"
+
+type sensorKey struct {
+	ID     byte
+	Sensor Sensor
+}
+
+// stuckRun is a sensor's current run of identical values.
+type stuckRun struct {
+	value float64
+	count int
+	since time.Time
+}
+
+// isStuck extends the message's run of identical values and reports whether
+// it has reached StuckCount and StuckDuration. Only decoded values are
+// checked. The rain counter and rain rate legitimately hold still through dry
+// weather, so are never stuck.
+func (p *Parser) isStuck(msg Message) bool {
+	if p.StuckCount <= 0 || msg.Sensor == Rain || msg.Sensor == RainRate {
+		return false
+	}
+
+	value, ok := msg.Value()
+	if !ok {
+		return false
+	}
+
+	key := sensorKey{msg.ID, msg.Sensor}
+	run, exists := p.stuckRuns[key]
+	if !exists || run.value != value {
+		run = stuckRun{value: value, since: msg.Time}
+	}
+	run.count++
+	p.stuckRuns[key] = run
+
+	return run.count >= p.StuckCount && msg.Time.Sub(run.since) >= p.StuckDuration
+}
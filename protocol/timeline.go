@@ -0,0 +1,48 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package protocol
+
+import "time"
+
+// Timeline converts sample indexes within successive batches of samples into
+// absolute times.
+type Timeline struct {
+	Start      time.Time
+	SampleRate int
+
+	// Samples consumed by previous batches.
+	offset int64
+}
+
+func NewTimeline(start time.Time, sampleRate int) Timeline {
+	return Timeline{Start: start, SampleRate: sampleRate}
+}
+
+// Time returns the time of the sample at idx within the current batch.
+func (t *Timeline) Time(idx int) time.Time {
+	sample, rate := t.offset+int64(idx), int64(t.SampleRate)
+
+	// Whole seconds first, so sample * time.Second can't overflow.
+	sec, rem := sample/rate, sample%rate
+	return t.Start.Add(time.Duration(sec)*time.Second + time.Duration(rem)*time.Second/time.Duration(rate))
+}
+
+// Advance moves the timeline past a batch of n samples.
+func (t *Timeline) Advance(n int) {
+	t.offset += int64(n)
+}
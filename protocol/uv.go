@@ -0,0 +1,101 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package protocol
+
+import "time"
+
+const (
+	// Erythemal irradiance of one UV index in W/m^2.
+	uvIndexIrradiance = 0.025
+	// Erythemal dose of one minimal erythemal dose (MED) in J/m^2, for
+	// skin type II.
+	medJoules = 210
+)
+
+// UVDose integrates UV index readings into the day's erythemal UV dose. Each
+// reading is held until the next, up to MaxGap, so missing readings don't
+// inflate the dose. The dose resets at local midnight.
+type UVDose struct {
+	MaxGap time.Duration
+
+	joules float64
+	last   float64
+	lastAt time.Time
+
+	now func() time.Time
+}
+
+func NewUVDose() *UVDose {
+	return &UVDose{
+		MaxGap: 5 * time.Minute,
+		now:    time.Now,
+	}
+}
+
+// SetClock replaces the clock used for integrating readings and the daily
+// reset, for testing. A nil clock restores time.Now.
+func (u *UVDose) SetClock(now func() time.Time) {
+	if now == nil {
+		now = time.Now
+	}
+	u.now = now
+}
+
+// Add integrates the previous reading up to now and holds the message's UV
+// index. Other messages are ignored.
+func (u *UVDose) Add(msg Message) {
+	uv, ok := msg.UVIndex()
+	if !ok {
+		return
+	}
+
+	now := u.now()
+	if !u.lastAt.IsZero() {
+		if !sameDay(u.lastAt, now) {
+			u.joules = 0
+		} else if elapsed := now.Sub(u.lastAt); elapsed <= u.MaxGap {
+			u.joules += u.last * uvIndexIrradiance * elapsed.Seconds()
+		}
+	}
+
+	u.last, u.lastAt = uv, now
+}
+
+// Joules returns the day's dose in J/m^2.
+func (u *UVDose) Joules() float64 {
+	if !u.lastAt.IsZero() && !sameDay(u.lastAt, u.now()) {
+		return 0
+	}
+	return u.joules
+}
+
+// MED returns the day's dose in minimal erythemal doses.
+func (u *UVDose) MED() float64 {
+	return u.Joules() / medJoules
+}
+
+// Reset clears the dose and the held reading.
+func (u *UVDose) Reset() {
+	u.joules, u.last, u.lastAt = 0, 0, time.Time{}
+}
+
+func sameDay(a, b time.Time) bool {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	return ay == by && am == bm && ad == bd
+}
@@ -0,0 +1,211 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package protocol
+
+import "time"
+
+// WindSummary describes the wind reported by one transmitter. Source is the
+// transmitter id, which differs from the ISS for a standalone anemometer
+// transmitter.
+type WindSummary struct {
+	Source byte
+
+	Samples   int
+	MeanSpeed float64
+	MaxSpeed  float64
+
+	Direction Reading
+}
+
+// WindStats tracks wind from each transmitter independently, so wind from an
+// anemometer transmitter isn't merged with the ISS it's paired with.
+type WindStats struct {
+	summaries map[byte]WindSummary
+}
+
+func NewWindStats() *WindStats {
+	return &WindStats{summaries: make(map[byte]WindSummary)}
+}
+
+// Add includes the message's wind in its transmitter's summary. Messages from
+// transmitters without a wind sensor are ignored.
+func (w *WindStats) Add(msg Message) {
+	speed, ok := msg.WindSpeedMPH()
+	if !ok {
+		return
+	}
+
+	s := w.summaries[msg.ID]
+	s.Source = msg.ID
+
+	s.Samples++
+	s.MeanSpeed += (speed - s.MeanSpeed) / float64(s.Samples)
+	if speed > s.MaxSpeed {
+		s.MaxSpeed = speed
+	}
+
+	if dir, ok := msg.WindDirectionDegrees(); ok && !msg.IsCalm() {
+		s.Direction = Reading{Value: dir, Time: msg.Time}
+	}
+
+	w.summaries[msg.ID] = s
+}
+
+// Summary returns the wind reported by a transmitter.
+func (w *WindStats) Summary(id byte) WindSummary {
+	s := w.summaries[id]
+	s.Source = id
+	return s
+}
+
+// GustWindow reports the highest gust over a rolling window, normalizing the
+// packet to packet peaks sent by the transmitter to a standard interval such
+// as 10 minutes. Feed it messages from a single transmitter.
+type GustWindow struct {
+	Window time.Duration
+
+	gusts []gustSample
+
+	now func() time.Time
+}
+
+type gustSample struct {
+	speed float64
+	time  time.Time
+}
+
+func NewGustWindow(window time.Duration) *GustWindow {
+	return &GustWindow{Window: window, now: time.Now}
+}
+
+// SetClock replaces the clock used for expiring gusts, for testing. A nil
+// clock restores time.Now.
+func (g *GustWindow) SetClock(now func() time.Time) {
+	if now == nil {
+		now = time.Now
+	}
+	g.now = now
+}
+
+// Add records the message's gust. Other messages are ignored.
+func (g *GustWindow) Add(msg Message) {
+	speed, ok := msg.WindGustMPH()
+	if !ok {
+		return
+	}
+
+	g.expire()
+	g.gusts = append(g.gusts, gustSample{speed, g.now()})
+}
+
+// Peak returns the highest gust within the window, false if there are none.
+func (g *GustWindow) Peak() (float64, bool) {
+	g.expire()
+	if len(g.gusts) == 0 {
+		return 0, false
+	}
+
+	peak := g.gusts[0].speed
+	for _, gust := range g.gusts[1:] {
+		if gust.speed > peak {
+			peak = gust.speed
+		}
+	}
+	return peak, true
+}
+
+// expire drops gusts older than the window.
+func (g *GustWindow) expire() {
+	now := g.now()
+
+	expired := 0
+	for expired < len(g.gusts) && now.Sub(g.gusts[expired].time) > g.Window {
+		expired++
+	}
+	g.gusts = g.gusts[expired:]
+}
+
+// Kilometres in a mile.
+const kmPerMile = 1.609344
+
+// WindRun integrates wind speed into the day's wind run, the distance the wind
+// has travelled. Each speed is held until the next message, up to MaxGap, so
+// missing messages don't inflate the run. The run resets at local midnight.
+type WindRun struct {
+	MaxGap time.Duration
+
+	miles  float64
+	last   float64
+	lastAt time.Time
+
+	now func() time.Time
+}
+
+func NewWindRun() *WindRun {
+	return &WindRun{
+		MaxGap: 5 * time.Minute,
+		now:    time.Now,
+	}
+}
+
+// SetClock replaces the clock used for integrating speeds and the daily
+// reset, for testing. A nil clock restores time.Now.
+func (w *WindRun) SetClock(now func() time.Time) {
+	if now == nil {
+		now = time.Now
+	}
+	w.now = now
+}
+
+// Add integrates the previous speed up to now and holds the message's wind
+// speed. Messages without a wind sensor are ignored.
+func (w *WindRun) Add(msg Message) {
+	speed, ok := msg.WindSpeedMPH()
+	if !ok {
+		return
+	}
+
+	now := w.now()
+	if !w.lastAt.IsZero() {
+		if !sameDay(w.lastAt, now) {
+			w.miles = 0
+		} else if elapsed := now.Sub(w.lastAt); elapsed <= w.MaxGap {
+			w.miles += w.last * elapsed.Hours()
+		}
+	}
+
+	w.last, w.lastAt = speed, now
+}
+
+// Miles returns the day's wind run in miles.
+func (w *WindRun) Miles() float64 {
+	if !w.lastAt.IsZero() && !sameDay(w.lastAt, w.now()) {
+		return 0
+	}
+	return w.miles
+}
+
+// Km returns the day's wind run in kilometres.
+func (w *WindRun) Km() float64 {
+	return w.Miles() * kmPerMile
+}
+
+// Reset clears the run and the held speed.
+func (w *WindRun) Reset() {
+	w.miles, w.last, w.lastAt = 0, 0, time.Time{}
+}
@@ -0,0 +1,139 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+// Package receiver ties hopping, tuning, demodulation and parsing together
+// into a complete receive loop for a device-agnostic radio.
+package receiver
+
+import (
+	"context"
+	"io"
+
+	"github.com/bemasher/rtldavis/protocol"
+)
+
+// RadioControl is the subset of an SDR the receive loop needs. Samples read
+// are interleaved 8-bit I/Q as produced by rtl-sdr.
+type RadioControl interface {
+	io.Reader
+	SetSampleRate(rate int) error
+	SetCenterFreq(freq int) error
+}
+
+// RunReceiver listens for the transmitter with the given id on region's
+// frequency plan, see Run. Out is closed when RunReceiver returns, including
+// when region is invalid.
+func RunReceiver(ctx context.Context, dev RadioControl, region protocol.Region, id int, out chan<- protocol.Message) error {
+	p, err := protocol.NewRegionParser(region, id)
+	if err != nil {
+		close(out)
+		return err
+	}
+	return Run(ctx, &p, dev, out)
+}
+
+// Run follows p's transmitter with dev, sending each message from p.ID to
+// out. Run returns ctx.Err() once ctx is cancelled, or the first error
+// returned by dev.
+//
+// Run owns out: it closes out when it returns, so callers must not send on or
+// close it themselves, and can range over it until Run is done. Dwell times
+// are measured on p's clock, see protocol.Parser.SetClock.
+func Run(ctx context.Context, p *protocol.Parser, dev RadioControl, out chan<- protocol.Message) error {
+	defer close(out)
+
+	// Disabled hops keep their dwell slot but aren't tuned to or counted
+	// as misses.
+	var current protocol.Hop
+	tune := func(hop protocol.Hop) error {
+		current = hop
+		if hop.Disabled {
+			return nil
+		}
+		return dev.SetCenterFreq(hop.ChannelFreq + hop.FreqError)
+	}
+
+	if err := dev.SetSampleRate(p.Cfg.SampleRate); err != nil {
+		return err
+	}
+	if err := tune(p.RandHop()); err != nil {
+		return err
+	}
+
+	// Wait one full rotation of the pattern + 1 on the first channel, some
+	// channels won't receive until the frequency error has been corrected.
+	deadline := p.Now().Add(p.ResyncDwell())
+	missCount := 3
+
+	block := make([]byte, p.Cfg.BlockSize2)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		if !p.Now().Before(deadline) {
+			deadline = p.Now().Add(p.CurrentDwell())
+			if !current.Disabled {
+				p.Missed()
+				missCount++
+			}
+
+			var hop protocol.Hop
+			if missCount >= 3 {
+				hop = p.RandHop()
+				deadline = p.Now().Add(p.ResyncDwell())
+			} else {
+				hop = p.NextHop()
+			}
+			if err := tune(hop); err != nil {
+				return err
+			}
+		}
+
+		if _, err := io.ReadFull(dev, block); err != nil {
+			return err
+		}
+
+		recvPacket := false
+		for _, msg := range p.Parse(p.Demodulate(block)) {
+			if int(msg.ID) != p.ID {
+				continue
+			}
+
+			recvPacket = true
+			select {
+			case out <- msg:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		if recvPacket {
+			missCount = 0
+
+			dwell := p.CurrentDwell()
+			deadline = p.Now().Add(dwell + dwell>>1)
+
+			if err := tune(p.NextHop()); err != nil {
+				return err
+			}
+		}
+	}
+}
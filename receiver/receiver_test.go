@@ -0,0 +1,202 @@
+/*
+   rtldavis, an rtl-sdr receiver for Davis Instruments weather stations.
+   Copyright (C) 2015  Douglas Hall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package receiver
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtldavis/protocol"
+)
+
+// fakeRadio repeats a canned buffer of samples regardless of tuning. Reading
+// advances clock by the duration of the samples read.
+type fakeRadio struct {
+	samples []byte
+	offset  int
+
+	sampleRate int
+	tuned      []int
+
+	clock time.Time
+}
+
+func (f *fakeRadio) SetSampleRate(rate int) error {
+	f.sampleRate = rate
+	return nil
+}
+
+func (f *fakeRadio) SetCenterFreq(freq int) error {
+	f.tuned = append(f.tuned, freq)
+	return nil
+}
+
+func (f *fakeRadio) Read(buf []byte) (n int, err error) {
+	for n < len(buf) {
+		c := copy(buf[n:], f.samples[f.offset:])
+		n += c
+		f.offset = (f.offset + c) % len(f.samples)
+	}
+	if f.sampleRate > 0 {
+		f.clock = f.clock.Add(time.Duration(n>>1) * time.Second / time.Duration(f.sampleRate))
+	}
+	return n, nil
+}
+
+// modulate frequency shift keys bits MSB first, cancelling the fs/4 rotation
+// applied by the demodulator.
+func modulate(cfg protocol.ParserConfig, data []byte, padding int) []byte {
+	const deviation = 20000
+
+	step := 2 * math.Pi * deviation / float64(cfg.SampleRate)
+
+	var samples []byte
+	var phase float64
+	emit := func(freq float64, n int) {
+		for ; n > 0; n-- {
+			rotate := -math.Pi / 2 * float64(len(samples)>>1)
+			samples = append(samples,
+				byte(127.4+100*math.Cos(phase+rotate)),
+				byte(127.4+100*math.Sin(phase+rotate)),
+			)
+			phase += freq
+		}
+	}
+
+	emit(0, padding)
+	for _, b := range data {
+		for bit := uint(0); bit < 8; bit++ {
+			if b>>(7-bit)&1 == 1 {
+				emit(step, cfg.SymbolLength)
+			} else {
+				emit(-step, cfg.SymbolLength)
+			}
+		}
+	}
+	emit(0, padding)
+
+	return samples
+}
+
+func TestRunReceiver(t *testing.T) {
+	p := protocol.NewParser(14, 0)
+	cfg := p.Config()
+
+	payload := p.AppendChecksum([]byte{0x80, 0x05, 0x40, 0x2D, 0x30, 0x00})
+	data := []byte{0xCB, 0x89}
+	for _, b := range payload {
+		data = append(data, protocol.SwapBitOrder(b))
+	}
+
+	radio := &fakeRadio{samples: modulate(cfg, data, 4096)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	out := make(chan protocol.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- RunReceiver(ctx, radio, protocol.EU, 0, out)
+	}()
+
+	msg, ok := <-out
+	if !ok {
+		t.Fatalf("receiver stopped: %v", <-done)
+	}
+	cancel()
+
+	if msg.Sensor != protocol.Temperature || msg.WindSpeed != 5 {
+		t.Fatalf("got %s, want temperature with wind speed 5", msg)
+	}
+	if temp, _ := msg.Temperature(); temp != 72.3 {
+		t.Fatalf("got temperature %v, want 72.3", temp)
+	}
+
+	for range out {
+	}
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+
+	if radio.sampleRate != cfg.SampleRate {
+		t.Fatalf("sample rate: got %d, want %d", radio.sampleRate, cfg.SampleRate)
+	}
+	if len(radio.tuned) < 2 {
+		t.Fatalf("tuned %d times, want a hop after receiving", len(radio.tuned))
+	}
+}
+
+func TestRunResync(t *testing.T) {
+	p := protocol.NewParser(14, 0)
+	p.ResyncBackoff = time.Second
+
+	// Nothing but noise, every dwell expires and resyncs.
+	radio := &fakeRadio{samples: make([]byte, 1<<16)}
+	radio.clock = time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.SetClock(func() time.Time { return radio.clock })
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Stop after the initial resync and three more.
+	var hops []string
+	var resyncs []time.Time
+	var dwells []time.Duration
+	p.Logf = func(format string, args ...interface{}) {
+		if strings.HasPrefix(format, "hop") || strings.HasPrefix(format, "resync") {
+			hops = append(hops, strings.Fields(format)[0])
+		}
+		if strings.HasPrefix(format, "resync") {
+			resyncs = append(resyncs, p.Now())
+			dwells = append(dwells, p.ResyncDwell())
+			if len(resyncs) == 4 {
+				cancel()
+			}
+		}
+	}
+
+	out := make(chan protocol.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- Run(ctx, &p, radio, out)
+	}()
+
+	for range out {
+	}
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+
+	for _, hop := range hops {
+		if hop != "resync:" {
+			t.Fatalf("got %q, want only resyncs", hops)
+		}
+	}
+
+	// Each resync waits its dwell, backing off, to within a block.
+	block := time.Duration(p.Cfg.BlockSize) * time.Second / time.Duration(p.Cfg.SampleRate)
+	for idx := 1; idx < len(resyncs); idx++ {
+		waited := resyncs[idx].Sub(resyncs[idx-1])
+		if waited < dwells[idx-1] || waited > dwells[idx-1]+block {
+			t.Fatalf("resync %d: waited %s, want %s", idx, waited, dwells[idx-1])
+		}
+	}
+	if dwells[len(dwells)-1] != dwells[0]+3*time.Second {
+		t.Fatalf("got dwells %v, want a second of backoff per resync", dwells)
+	}
+}